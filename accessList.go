@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessReloadInterval is how often IP list files are checked for changes
+const accessReloadInterval = 10 * time.Second
+
+// Access is the result of checking an IP against access rules
+type Access int
+
+const (
+	// AccessDefault means the IP is on neither list
+	AccessDefault Access = iota
+	// AccessAllowed means the IP is allowlisted
+	AccessAllowed
+	// AccessDenied means the IP is blocked
+	AccessDenied
+)
+
+// IPList is a set of networks from the configuration and, optionally, a
+// plain-text file with one CIDR range or IP address per line. The file is
+// read again whenever its modification time changes, and the inline
+// networks can be replaced with SetInline.
+type IPList struct {
+	path    string
+	mu      sync.RWMutex
+	inline  []*net.IPNet
+	loaded  []*net.IPNet // From the list file
+	nets    []*net.IPNet // inline and loaded together
+	modTime time.Time
+}
+
+// NewIPList creates a list from CIDR ranges and an optional list file
+func NewIPList(cidrs []string, path string) (*IPList, error) {
+	inline, err := parseNetworks(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	l := &IPList{path: path, inline: inline, nets: inline}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetInline replaces the networks from the configuration, keeping those
+// from the list file. It reports whether the networks changed.
+func (l *IPList) SetInline(nets []*net.IPNet) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if slices.EqualFunc(l.inline, nets, func(a, b *net.IPNet) bool { return a.String() == b.String() }) {
+		return false
+	}
+	l.inline = nets
+	l.nets = slices.Concat(l.inline, l.loaded)
+	return true
+}
+
+// Contains reports whether ip belongs to the list
+func (l *IPList) Contains(ip net.IP) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reads the list file again if it changed since it was last read.
+// On error, the previous list stays in effect.
+func (l *IPList) Reload() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("error reading IP list: %w", err)
+	}
+	l.mu.RLock()
+	unchanged, initial := info.ModTime().Equal(l.modTime), l.modTime.IsZero()
+	l.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	loaded, err := readIPListFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.loaded = loaded
+	l.nets = slices.Concat(l.inline, loaded)
+	l.modTime = info.ModTime()
+	l.mu.Unlock()
+
+	if !initial {
+		log.Printf("Reloaded %d networks from %s.", len(loaded), l.path)
+	}
+	return nil
+}
+
+// readIPListFile parses a list file. Blank lines and everything after a #
+// are ignored.
+func readIPListFile(path string) ([]*net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening IP list: %w", err)
+	}
+	defer file.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parsed, err := parseNetworks([]string{entry})
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		nets = append(nets, parsed...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading IP list: %w", err)
+	}
+	return nets, nil
+}
+
+// AccessRules combines an allowlist and a denylist. Allowlisted IPs are
+// exempt from rate limits and complexity escalation, and take precedence
+// over the denylist, so exceptions can be carved out of blocked ranges.
+type AccessRules struct {
+	allow   *IPList
+	deny    *IPList
+	blocked atomic.Int64
+}
+
+// NewAccessRules creates access rules from configured ranges and list files
+func NewAccessRules(allow []string, allowFile string, deny []string, denyFile string) (*AccessRules, error) {
+	allowList, err := NewIPList(allow, allowFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %w", err)
+	}
+	denyList, err := NewIPList(deny, denyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denylist: %w", err)
+	}
+	return &AccessRules{allow: allowList, deny: denyList}, nil
+}
+
+// Check returns the access of an IP. Rules may be nil, allowing everyone.
+func (a *AccessRules) Check(ip string) Access {
+	if a == nil {
+		return AccessDefault
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return AccessDefault
+	}
+	if a.allow.Contains(parsed) {
+		return AccessAllowed
+	}
+	if a.deny.Contains(parsed) {
+		return AccessDenied
+	}
+	return AccessDefault
+}
+
+// countBlocked counts a request refused by the denylist
+func (a *AccessRules) countBlocked() {
+	a.blocked.Add(1)
+}
+
+// Blocked returns the number of requests refused by the denylist
+func (a *AccessRules) Blocked() int64 {
+	if a == nil {
+		return 0
+	}
+	return a.blocked.Load()
+}
+
+// SetInline replaces the inline ranges of both lists, keeping those from
+// the list files. Neither list changes if a range is invalid. It reports
+// whether the lists changed.
+func (a *AccessRules) SetInline(allow, deny []string) (bool, error) {
+	if a == nil {
+		return false, nil
+	}
+	allowNets, err := parseNetworks(allow)
+	if err != nil {
+		return false, fmt.Errorf("invalid allowlist: %w", err)
+	}
+	denyNets, err := parseNetworks(deny)
+	if err != nil {
+		return false, fmt.Errorf("invalid denylist: %w", err)
+	}
+	allowChanged := a.allow.SetInline(allowNets)
+	denyChanged := a.deny.SetInline(denyNets)
+	return allowChanged || denyChanged, nil
+}
+
+// Reload picks up changes to the list files
+func (a *AccessRules) Reload() {
+	if a == nil {
+		return
+	}
+	if err := a.allow.Reload(); err != nil {
+		log.Printf("Error reloading allowlist: %v", err)
+	}
+	if err := a.deny.Reload(); err != nil {
+		log.Printf("Error reloading denylist: %v", err)
+	}
+}
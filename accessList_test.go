@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeListFile writes a list file and moves its modification time
+// forward, so a reload sees the change even within the clock's resolution
+func writeListFile(t *testing.T, path, content string, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	writeListFile(t, path, "# Office\n198.51.100.0/24\n\n  2001:db8::/32 # VPN\n203.0.113.7\n", time.Hour)
+	list, err := NewIPList([]string{"192.0.2.1", "10.0.0.0/8"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"10.255.0.1", true},
+		{"198.51.100.200", true},
+		{"198.51.101.1", false},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"203.0.113.7", true},
+		{"::ffff:203.0.113.7", true},
+		{"203.0.113.8", false},
+	}
+	check := func(when string) {
+		t.Helper()
+		for _, tt := range tests {
+			if got := list.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("%s: Contains(%s) = %v, want %v", when, tt.ip, got, tt.want)
+			}
+		}
+	}
+	check("loaded")
+
+	// A file that fails to parse leaves the previous list in effect
+	writeListFile(t, path, "198.51.100.0/24\nnot a range\n", 30*time.Minute)
+	if err := list.Reload(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("Reload of an invalid file = %v, want an error naming line 2", err)
+	}
+	check("after a failed reload")
+
+	// A changed file replaces the networks read from it, but not the inline ones
+	writeListFile(t, path, "203.0.113.8\n", 0)
+	if err := list.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains(net.ParseIP("203.0.113.8")) || list.Contains(net.ParseIP("198.51.100.1")) {
+		t.Error("reload did not replace the networks of the file")
+	}
+	if !list.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("reload dropped the inline networks")
+	}
+
+	// Replacing the inline networks keeps those of the file
+	nets, _ := parseNetworks([]string{"192.0.2.2"})
+	if !list.SetInline(nets) || list.SetInline(nets) {
+		t.Error("SetInline did not report exactly one change")
+	}
+	if !list.Contains(net.ParseIP("192.0.2.2")) || list.Contains(net.ParseIP("192.0.2.1")) || !list.Contains(net.ParseIP("203.0.113.8")) {
+		t.Error("SetInline did not replace only the inline networks")
+	}
+
+	if _, err := NewIPList([]string{"192.0.2.0/33"}, ""); err == nil {
+		t.Error("NewIPList accepted an invalid range")
+	}
+	if _, err := NewIPList(nil, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("NewIPList accepted a missing file")
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	rules, err := NewAccessRules([]string{"192.0.2.7"}, "", []string{"192.0.2.0/24", "2001:db8::/32"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want Access
+	}{
+		{"192.0.2.7", AccessAllowed}, // The allowlist wins over the denylist
+		{"192.0.2.8", AccessDenied},
+		{"2001:db8::1", AccessDenied},
+		{"198.51.100.1", AccessDefault},
+		{"not an ip", AccessDefault},
+	}
+	for _, tt := range tests {
+		if got := rules.Check(tt.ip); got != tt.want {
+			t.Errorf("Check(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	var none *AccessRules
+	if none.Check("192.0.2.8") != AccessDefault || none.Blocked() != 0 {
+		t.Error("nil rules restrict access")
+	}
+
+	// Invalid inline ranges change neither list
+	if _, err := rules.SetInline([]string{"198.51.100.1"}, []string{"invalid"}); err == nil {
+		t.Error("SetInline accepted an invalid range")
+	}
+	if rules.Check("198.51.100.1") != AccessDefault || rules.Check("192.0.2.7") != AccessAllowed {
+		t.Error("a failed SetInline changed the lists")
+	}
+	if changed, err := rules.SetInline(nil, []string{"198.51.100.0/24"}); err != nil || !changed {
+		t.Fatalf("SetInline = %v, %v", changed, err)
+	}
+	if rules.Check("192.0.2.7") != AccessDefault || rules.Check("198.51.100.1") != AccessDenied {
+		t.Error("SetInline did not replace the lists")
+	}
+}
+
+func TestAccessListsBlockRequests(t *testing.T) {
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		config.DenyList = []string{"192.0.2.0/24"}
+		for id, key := range config.APIKeys {
+			key.DenyList = []string{"198.51.100.0/24"}
+			config.APIKeys[id] = key
+		}
+	})
+	handler := testRouter(s)
+
+	request := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("Authorization", "Bearer "+keys.SiteKey)
+		req.Header.Set("Origin", testOrigin)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := request("192.0.2.1"); code != http.StatusForbidden {
+		t.Errorf("globally denied IP got %d, want 403", code)
+	}
+	if code := request("198.51.100.1"); code != http.StatusForbidden {
+		t.Errorf("IP denied for the key got %d, want 403", code)
+	}
+	if code := request("203.0.113.1"); code != http.StatusOK {
+		t.Errorf("other IP got %d, want 200", code)
+	}
+	if blocked := s.access.Blocked(); blocked != 1 {
+		t.Errorf("globally blocked requests = %d, want 1", blocked)
+	}
+	if blocked := s.Stats()[keys.ID].BlockedRequests; blocked != 1 {
+		t.Errorf("requests blocked for the key = %d, want 1", blocked)
+	}
+}
+
+func TestReloadInlineLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	if err := ensureConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		config.Path = path
+	})
+	err := UpdateConfig(path, func(config *ServerConfig) error {
+		config.DenyList = []string{"192.0.2.0/24"}
+		key := s.config.APIKeys[keys.ID]
+		key.AllowList = []string{"198.51.100.7"}
+		config.APIKeys[keys.ID] = key
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.reloadInlineLists()
+	if s.access.Check("192.0.2.1") != AccessDenied {
+		t.Error("global denylist not reloaded")
+	}
+	if s.keyAccess[keys.ID].Check("198.51.100.7") != AccessAllowed {
+		t.Error("allowlist of the key not reloaded")
+	}
+
+	// An invalid list in the file keeps the lists in effect
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := strings.Replace(string(raw), "192.0.2.0/24", "192.0.2.0/99", 1)
+	writeListFile(t, path, broken, -time.Minute)
+	s.reloadInlineLists()
+	if s.access.Check("192.0.2.1") != AccessDenied {
+		t.Error("an invalid denylist replaced the one in effect")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/altcha-org/altcha-lib-go"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+const (
+	// apiKeyPrefix starts every API key
+	apiKeyPrefix = "vrty_"
+	// secretKeyPrefix starts secret keys, used by backends to verify
+	// solutions, as opposed to the site keys embedded in web pages
+	secretKeyPrefix = apiKeyPrefix + "sk_"
+)
+
+// KeyScope is an endpoint group an API key may be allowed to call
+type KeyScope int
+
+const (
+	// KeyScopeChallenge is requesting challenges, with the site key
+	KeyScopeChallenge KeyScope = iota
+	// KeyScopeVerify is verifying solutions, with the secret key
+	KeyScopeVerify
+)
+
+// APIKey holds the settings of an API key, a pair of a public site key and
+// a secret key. The challenge settings override the global ones when set.
+// Keys are stored by ID, with salted hashes of their secrets rather than
+// the secrets themselves.
+type APIKey struct {
+	Salt          string           `mapstructure:"salt" json:"-" yaml:"salt"`
+	Hash          string           `mapstructure:"hash" json:"-" yaml:"hash"`
+	SecretKeySalt string           `mapstructure:"secretKeySalt" json:"-" yaml:"secretKeySalt,omitempty"`
+	SecretKeyHash string           `mapstructure:"secretKeyHash" json:"-" yaml:"secretKeyHash,omitempty"`
+	Label         string           `mapstructure:"label" json:"label,omitempty" yaml:"label,omitempty"`
+	Owner         string           `mapstructure:"owner" json:"owner,omitempty" yaml:"owner,omitempty"`
+	CreatedAt     time.Time        `mapstructure:"createdAt" json:"createdAt" yaml:"createdAt"`
+	ExpiresAt     time.Time        `mapstructure:"expiresAt" json:"expiresAt,omitempty" yaml:"expiresAt,omitempty"`
+	Enabled       bool             `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
+	Notes         string           `mapstructure:"notes" json:"notes,omitempty" yaml:"notes,omitempty"`
+	Origins       []string         `mapstructure:"origins" json:"origins" yaml:"origins"`
+	RateLimit     string           `mapstructure:"rateLimit" json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"`
+	Burst         int              `mapstructure:"burst" json:"burst,omitempty" yaml:"burst,omitempty"`
+	DailyQuota    int64            `mapstructure:"dailyQuota" json:"dailyQuota,omitempty" yaml:"dailyQuota,omitempty"`
+	MonthlyQuota  int64            `mapstructure:"monthlyQuota" json:"monthlyQuota,omitempty" yaml:"monthlyQuota,omitempty"`
+	AllowList     []string         `mapstructure:"allowList" json:"allowList,omitempty" yaml:"allowList,omitempty"`
+	AllowListFile string           `mapstructure:"allowListFile" json:"allowListFile,omitempty" yaml:"allowListFile,omitempty"`
+	DenyList      []string         `mapstructure:"denyList" json:"denyList,omitempty" yaml:"denyList,omitempty"`
+	DenyListFile  string           `mapstructure:"denyListFile" json:"denyListFile,omitempty" yaml:"denyListFile,omitempty"`
+	Algorithm     altcha.Algorithm `mapstructure:"algorithm" json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	MinComplexity int64            `mapstructure:"minComplexity" json:"minComplexity,omitempty" yaml:"minComplexity,omitempty"`
+	MaxComplexity int64            `mapstructure:"maxComplexity" json:"maxComplexity,omitempty" yaml:"maxComplexity,omitempty"`
+	ExpireTime    string           `mapstructure:"expireTime" json:"expireTime,omitempty" yaml:"expireTime,omitempty"`
+	SaltLength    int              `mapstructure:"saltLength" json:"saltLength,omitempty" yaml:"saltLength,omitempty"`
+}
+
+// NewAPIKey returns the settings of a new, enabled key for origins
+func NewAPIKey(origins []string) APIKey {
+	return APIKey{
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Enabled:   true,
+		Origins:   origins,
+	}
+}
+
+// GenerateKeyID generates a new API key ID
+func GenerateKeyID() (string, error) {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// issue gives the key a new site key, and returns it. Only a hash of its
+// secret is kept, so the site key can't be shown again.
+func (k *APIKey) issue(id string) (string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	if k.Salt, k.Hash, err = hashKeySecret(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + id + "_" + secret, nil
+}
+
+// issueSecretKey gives the key a new secret key, replacing any previous
+// one, and returns it. Like the site key, it can't be shown again.
+func (k *APIKey) issueSecretKey(id string) (string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	if k.SecretKeySalt, k.SecretKeyHash, err = hashKeySecret(secret); err != nil {
+		return "", err
+	}
+	return secretKeyPrefix + id + "_" + secret, nil
+}
+
+// hasSecretKey reports whether a secret key was issued for the key. Keys
+// created before secret keys existed verify with their site key.
+func (k APIKey) hasSecretKey() bool {
+	return k.SecretKeyHash != ""
+}
+
+// allows reports whether the site key, or the secret key if secretKey is
+// set, may be used for scope
+func (k APIKey) allows(scope KeyScope, secretKey bool) bool {
+	if secretKey {
+		return scope == KeyScopeVerify
+	}
+	return scope == KeyScopeChallenge || !k.hasSecretKey()
+}
+
+// allowsOrigin reports whether the site key may be used from origin
+func (k APIKey) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowedOrigin := range k.Origins {
+		if origin == allowedOrigin || allowedOrigin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecret reports in constant time whether secret is the secret of the
+// site key
+func (k APIKey) checkSecret(secret string) bool {
+	return matchesHash(k.Salt, k.Hash, secret)
+}
+
+// checkSecretKey reports in constant time whether secret is the secret of
+// the secret key
+func (k APIKey) checkSecretKey(secret string) bool {
+	return matchesHash(k.SecretKeySalt, k.SecretKeyHash, secret)
+}
+
+// newSecret generates the random part of a key
+func newSecret() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// hashKeySecret returns a random salt and the salted hash of a key secret
+func hashKeySecret(secret string) (salt, hash string, err error) {
+	saltBytes := make([]byte, 16)
+	if _, err := rand.Read(saltBytes); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(saltBytes), hex.EncodeToString(hashSecret(saltBytes, secret)), nil
+}
+
+// matchesHash reports in constant time whether secret has the given salted
+// hash
+func matchesHash(saltHex, hashHex, secret string) bool {
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return false
+	}
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil || len(hash) != sha256.Size {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashSecret(salt, secret), hash) == 1
+}
+
+// hashSecret hashes a key secret with its salt
+func hashSecret(salt []byte, secret string) []byte {
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(secret))
+	return hash.Sum(nil)
+}
+
+// parseAPIKey splits a site key into its ID and secret. Keys created before
+// IDs existed, vrty_ followed by the secret, get an ID derived from the key.
+func parseAPIKey(apiKey string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(apiKey, apiKeyPrefix)
+	if !found || rest == "" || strings.HasPrefix(apiKey, secretKeyPrefix) {
+		return "", "", false
+	}
+	if id, secret, found := strings.Cut(rest, "_"); found {
+		return id, secret, id != "" && secret != ""
+	}
+	return legacyKeyID(apiKey), apiKey, true
+}
+
+// parseSecretKey splits a secret key into its ID and secret
+func parseSecretKey(apiKey string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(apiKey, secretKeyPrefix)
+	if !found {
+		return "", "", false
+	}
+	id, secret, found = strings.Cut(rest, "_")
+	return id, secret, found && id != "" && secret != ""
+}
+
+// legacyKeyID returns the ID of a key created before IDs existed
+func legacyKeyID(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:8])
+}
+
+// hashLegacyKeys replaces API keys stored in plaintext, as by older
+// versions, with their ID and a hash, moving their stats along, and gives
+// keys without one a creation time. It returns the number of keys changed.
+func hashLegacyKeys(config *ServerConfig, now time.Time) (int, error) {
+	migrated := 0
+	for apiKey, key := range config.APIKeys {
+		plaintext := strings.HasPrefix(apiKey, apiKeyPrefix)
+		if !plaintext && !key.CreatedAt.IsZero() {
+			continue
+		}
+
+		id := apiKey
+		if plaintext {
+			id = legacyKeyID(apiKey)
+			var err error
+			if key.Salt, key.Hash, err = hashKeySecret(apiKey); err != nil {
+				return migrated, fmt.Errorf("error hashing API key: %w", err)
+			}
+			delete(config.APIKeys, apiKey)
+			if stats, exists := config.Stats[apiKey]; exists {
+				config.Stats[id] = stats
+				delete(config.Stats, apiKey)
+			}
+		}
+		if key.CreatedAt.IsZero() {
+			key.CreatedAt = now
+		}
+		config.APIKeys[id] = key
+		migrated++
+	}
+	return migrated, nil
+}
+
+// Expired reports whether the key has an expiry time that has passed
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// clampComplexity limits a complexity to the range of the key
+func (k APIKey) clampComplexity(complexity int64) int64 {
+	if k.MinComplexity > 0 && complexity < k.MinComplexity {
+		return k.MinComplexity
+	}
+	if k.MaxComplexity > 0 && complexity > k.MaxComplexity {
+		return k.MaxComplexity
+	}
+	return complexity
+}
+
+// accessRules returns the allowlist and denylist of the key
+func (k APIKey) accessRules() (*AccessRules, error) {
+	return NewAccessRules(k.AllowList, k.AllowListFile, k.DenyList, k.DenyListFile)
+}
+
+// decodeHook returns the viper decoder option used for the configuration.
+// It keeps viper's default hooks and accepts API keys written in the old
+// format, a plain list of origins.
+func decodeHook() viper.DecoderConfigOption {
+	return viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToSliceHookFunc(","),
+		legacyAPIKeyHook,
+	))
+}
+
+// legacyAPIKeyHook converts a list of origins into an APIKey. Keys written
+// before the enabled flag existed are enabled.
+func legacyAPIKeyHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(APIKey{}) {
+		return data, nil
+	}
+	switch from.Kind() {
+	case reflect.Slice:
+		return map[string]interface{}{"origins": data, "enabled": true}, nil
+	case reflect.Map:
+		fields, ok := data.(map[string]interface{})
+		if !ok || hasField(fields, "enabled") {
+			return data, nil
+		}
+		withDefault := make(map[string]interface{}, len(fields)+1)
+		for name, value := range fields {
+			withDefault[name] = value
+		}
+		withDefault["enabled"] = true
+		return withDefault, nil
+	}
+	return data, nil
+}
+
+// isLegacyAPIKey reports whether a raw API key entry from the config file
+// predates the current format, and should be rewritten
+func isLegacyAPIKey(apiKey string, entry interface{}) bool {
+	if strings.HasPrefix(apiKey, apiKeyPrefix) {
+		return true
+	}
+	fields, ok := entry.(map[string]interface{})
+	return !ok || !hasField(fields, "enabled") || !hasField(fields, "createdAt")
+}
+
+// hasField reports whether a decoded config map holds a field. Viper
+// lowercases keys, so names are compared case-insensitively.
+func hasField(fields map[string]interface{}, name string) bool {
+	for field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacyTestKey is a key in the format used before key IDs existed
+const legacyTestKey = "vrty_0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseAPIKey(t *testing.T) {
+	tests := []struct {
+		apiKey     string
+		wantID     string
+		wantSecret string
+		wantOK     bool
+	}{
+		{"vrty_0123abcd_s3cr3t", "0123abcd", "s3cr3t", true},
+		{legacyTestKey, legacyKeyID(legacyTestKey), legacyTestKey, true},
+		{"vrty_sk_0123abcd_s3cr3t", "", "", false},
+		{"vrty_", "", "", false},
+		{"vrty__s3cr3t", "", "", false},
+		{"vrty_0123abcd_", "", "", false},
+		{"0123abcd_s3cr3t", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		id, secret, ok := parseAPIKey(tt.apiKey)
+		if ok != tt.wantOK || (ok && (id != tt.wantID || secret != tt.wantSecret)) {
+			t.Errorf("parseAPIKey(%q) = %q, %q, %v; want %q, %q, %v", tt.apiKey, id, secret, ok, tt.wantID, tt.wantSecret, tt.wantOK)
+		}
+	}
+}
+
+func TestParseSecretKey(t *testing.T) {
+	tests := []struct {
+		apiKey     string
+		wantID     string
+		wantSecret string
+		wantOK     bool
+	}{
+		{"vrty_sk_0123abcd_s3cr3t", "0123abcd", "s3cr3t", true},
+		{"vrty_0123abcd_s3cr3t", "", "", false},
+		{"vrty_sk_0123abcd", "", "", false},
+		{"vrty_sk__s3cr3t", "", "", false},
+		{"vrty_sk_0123abcd_", "", "", false},
+	}
+	for _, tt := range tests {
+		id, secret, ok := parseSecretKey(tt.apiKey)
+		if ok != tt.wantOK || (ok && (id != tt.wantID || secret != tt.wantSecret)) {
+			t.Errorf("parseSecretKey(%q) = %q, %q, %v; want %q, %q, %v", tt.apiKey, id, secret, ok, tt.wantID, tt.wantSecret, tt.wantOK)
+		}
+	}
+}
+
+func TestLegacyKeyID(t *testing.T) {
+	id := legacyKeyID(legacyTestKey)
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 16 {
+		t.Errorf("legacyKeyID = %q, want 16 hex digits", id)
+	}
+	if legacyKeyID(legacyTestKey) != id {
+		t.Error("legacyKeyID is not stable")
+	}
+	if legacyKeyID(legacyTestKey+"0") == id {
+		t.Error("different keys got the same ID")
+	}
+}
+
+func TestMatchesHash(t *testing.T) {
+	salt, hash, err := hashKeySecret("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		salt   string
+		hash   string
+		secret string
+		want   bool
+	}{
+		{"matching", salt, hash, "s3cr3t", true},
+		{"wrong secret", salt, hash, "s3cr3T", false},
+		{"empty secret", salt, hash, "", false},
+		{"other salt", strings.Repeat("00", 16), hash, "s3cr3t", false},
+		{"salt not hex", "not hex", hash, "s3cr3t", false},
+		{"hash not hex", salt, "not hex", "s3cr3t", false},
+		{"hash too short", salt, hash[:len(hash)-2], "s3cr3t", false},
+		{"hash too long", salt, hash + "00", "s3cr3t", false},
+		{"no hash", salt, "", "s3cr3t", false},
+		{"no salt or hash", "", "", "", false},
+	}
+	for _, tt := range tests {
+		if got := matchesHash(tt.salt, tt.hash, tt.secret); got != tt.want {
+			t.Errorf("%s: matchesHash = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHashLegacyKeys(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	created := now.Add(-time.Hour)
+	config := &ServerConfig{
+		APIKeys: map[string]APIKey{
+			legacyTestKey: {Origins: []string{testOrigin}, Enabled: true},
+			"0123abcd":    {Salt: "00", Hash: "11", Enabled: true},
+			"4567cdef":    {Salt: "22", Hash: "33", Enabled: true, CreatedAt: created},
+		},
+		Stats: map[string]StatsEntry{
+			legacyTestKey: {TotalChallenges: 7, SolvedChallenges: 5},
+			"4567cdef":    {TotalChallenges: 3},
+		},
+	}
+
+	migrated, err := hashLegacyKeys(config, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Errorf("migrated %d keys, want 2", migrated)
+	}
+
+	id := legacyKeyID(legacyTestKey)
+	key, ok := config.APIKeys[id]
+	if !ok {
+		t.Fatalf("legacy key not stored under its ID %s: %v", id, config.APIKeys)
+	}
+	if _, ok := config.APIKeys[legacyTestKey]; ok {
+		t.Error("legacy key is still stored in plaintext")
+	}
+	if !matchesSiteKey(key, legacyTestKey) {
+		t.Error("legacy key does not match its hash")
+	}
+	if !key.CreatedAt.Equal(now) || key.Origins[0] != testOrigin || !key.Enabled {
+		t.Errorf("legacy key settings not kept: %+v", key)
+	}
+	if stats, ok := config.Stats[id]; !ok || stats.TotalChallenges != 7 || stats.SolvedChallenges != 5 {
+		t.Errorf("stats not moved to the new ID: %+v", config.Stats)
+	}
+	if _, ok := config.Stats[legacyTestKey]; ok {
+		t.Error("stats are still stored under the plaintext key")
+	}
+
+	if key := config.APIKeys["0123abcd"]; !key.CreatedAt.Equal(now) || key.Hash != "11" {
+		t.Errorf("key without creation time = %+v", key)
+	}
+	if key := config.APIKeys["4567cdef"]; !key.CreatedAt.Equal(created) || config.Stats["4567cdef"].TotalChallenges != 3 {
+		t.Errorf("current key was changed: %+v", key)
+	}
+
+	// Migrated keys are left alone
+	before := config.APIKeys[id]
+	if migrated, err := hashLegacyKeys(config, now.Add(time.Hour)); err != nil || migrated != 0 {
+		t.Errorf("second run migrated %d keys, error %v", migrated, err)
+	}
+	if after := config.APIKeys[id]; after.Hash != before.Hash || after.Salt != before.Salt || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Error("second run changed a migrated key")
+	}
+}
+
+func TestClampComplexity(t *testing.T) {
+	tests := []struct {
+		key        APIKey
+		complexity int64
+		want       int64
+	}{
+		{APIKey{}, 50000, 50000},
+		{APIKey{MinComplexity: 1000, MaxComplexity: 2000}, 500, 1000},
+		{APIKey{MinComplexity: 1000, MaxComplexity: 2000}, 1500, 1500},
+		{APIKey{MinComplexity: 1000, MaxComplexity: 2000}, 5000, 2000},
+		{APIKey{MinComplexity: 1000}, 5000, 5000},
+		{APIKey{MaxComplexity: 2000}, 1, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.key.clampComplexity(tt.complexity); got != tt.want {
+			t.Errorf("clampComplexity(%d) with range %d-%d = %d, want %d",
+				tt.complexity, tt.key.MinComplexity, tt.key.MaxComplexity, got, tt.want)
+		}
+	}
+}
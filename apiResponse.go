@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ErrorCode is a stable, machine-readable reason a request failed
+type ErrorCode string
+
+const (
+	// CodeMalformed is a request or payload that can't be decoded
+	CodeMalformed ErrorCode = "malformed"
+	// CodeTooLarge is a request body over maxBodyBytes
+	CodeTooLarge ErrorCode = "too_large"
+	// CodeBadSignature is a wrong solution, or a challenge not issued by
+	// this server
+	CodeBadSignature ErrorCode = "bad_signature"
+	// CodeExpired is a challenge past its expiry time
+	CodeExpired ErrorCode = "expired"
+	// CodeReplayed is a challenge that was already solved
+	CodeReplayed ErrorCode = "replayed"
+	// CodeWrongKey is a challenge issued for another API key
+	CodeWrongKey ErrorCode = "wrong_key"
+	// CodeMissingKey is a request without an API key
+	CodeMissingKey ErrorCode = "missing_key"
+	// CodeInvalidKey is an unknown or malformed API key
+	CodeInvalidKey ErrorCode = "invalid_key"
+	// CodeKeyDisabled is a disabled API key
+	CodeKeyDisabled ErrorCode = "key_disabled"
+	// CodeKeyExpired is an API key past its expiry time
+	CodeKeyExpired ErrorCode = "key_expired"
+	// CodeWrongScope is a site key used to verify, or a secret key used to
+	// request challenges
+	CodeWrongScope ErrorCode = "wrong_scope"
+	// CodeOriginMismatch is an origin the API key isn't valid for
+	CodeOriginMismatch ErrorCode = "origin_mismatch"
+	// CodeIPBlocked is a client on a denylist
+	CodeIPBlocked ErrorCode = "ip_blocked"
+	// CodeRateLimited is a client or API key over its rate limit
+	CodeRateLimited ErrorCode = "rate_limited"
+	// CodeQuotaExceeded is an API key over its daily or monthly quota
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// CodeInternal is a failure of the server
+	CodeInternal ErrorCode = "internal_error"
+)
+
+// verifyStatus is the HTTP status of each way a verification can fail
+var verifyStatus = map[ErrorCode]int{
+	CodeMalformed:    http.StatusBadRequest,
+	CodeBadSignature: http.StatusUnprocessableEntity,
+	CodeExpired:      http.StatusUnprocessableEntity,
+	CodeWrongKey:     http.StatusUnprocessableEntity,
+	CodeReplayed:     http.StatusConflict,
+}
+
+const (
+	// LegacyResponsesContextKey is the context key for whether a route
+	// answers in the format of older versions
+	LegacyResponsesContextKey ContextKey = "legacyResponses"
+	// SiteVerifyContextKey is the context key for whether a route answers
+	// in the siteverify format
+	SiteVerifyContextKey ContextKey = "siteVerify"
+)
+
+// ErrorResponse is the body of a failed request
+type ErrorResponse struct {
+	Error   ErrorCode `json:"error"`
+	Message string    `json:"message"`
+}
+
+// VerifyResponse is the body of a successful verification
+type VerifyResponse struct {
+	Success  bool   `json:"success"`
+	IssuedAt string `json:"issuedAt,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// APIVersionMiddleware records the API version of a route group, which
+// decides the format of its responses. Version 1 keeps the code and message
+// format of older versions while legacyV1Responses is set.
+func (s *Server) APIVersionMiddleware(version int) func(http.Handler) http.Handler {
+	legacy := version == 1 && s.config.LegacyV1
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), LegacyResponsesContextKey, legacy)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// legacyResponses reports whether a request gets responses in the format
+// of older versions
+func legacyResponses(r *http.Request) bool {
+	legacy, _ := r.Context().Value(LegacyResponsesContextKey).(bool)
+	return legacy
+}
+
+// writeError writes an error response in the format of the request's API
+// version, or of siteverify
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	if siteVerifyResponses(r) {
+		errorCode, ok := siteVerifyRejections[code]
+		if !ok {
+			errorCode = "bad-request"
+		}
+		writeSiteVerifyResponse(w, SiteVerifyResponse{ErrorCodes: []string{errorCode}, Message: message})
+		return
+	}
+	if legacyResponses(r) {
+		writeJSON(w, status, Response{Code: status, Message: message})
+		return
+	}
+	writeJSON(w, status, ErrorResponse{Error: code, Message: message})
+}
+
+// writeVerification writes the outcome of a verification in the format of
+// the request's API version. Older versions report rejected solutions with
+// HTTP 200, except for malformed and replayed ones.
+func writeVerification(w http.ResponseWriter, r *http.Request, result Verification) {
+	switch {
+	case result.Error != "":
+		if legacyResponses(r) && verifyStatus[result.Error] == http.StatusUnprocessableEntity {
+			writeJSON(w, http.StatusOK, Response{Code: http.StatusBadRequest, Message: "Invalid payload"})
+			return
+		}
+		writeError(w, r, verifyStatus[result.Error], result.Error, result.Message)
+	case legacyResponses(r):
+		writeJSON(w, http.StatusOK, Response{Code: http.StatusOK, Message: "OK"})
+	default:
+		reply := VerifyResponse{Success: true, Hostname: result.Hostname}
+		if !result.IssuedAt.IsZero() {
+			reply.IssuedAt = result.IssuedAt.Format(time.RFC3339)
+		}
+		writeJSON(w, http.StatusOK, reply)
+	}
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -1,65 +1,113 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"sync"
 	"time"
 )
 
-type ChallengeManager struct {
-	solvedChallenges map[string]int64
-	mu               sync.Mutex
+const (
+	// ReplayStoreMemory keeps solved challenges in process memory
+	ReplayStoreMemory = "memory"
+)
+
+// ChallengeManager keeps track of solved challenges to prevent replay attacks.
+// Expiry times are Unix timestamps in seconds, as found in the challenge salt.
+type ChallengeManager interface {
+	// AddChallenge marks a challenge as solved until expireAt
+	AddChallenge(challenge string, expireAt int64) error
+	// Exists reports whether a challenge has already been solved
+	Exists(challenge string) (bool, error)
+	// TryConsume atomically marks a challenge as solved and reports
+	// whether it was unsolved before the call
+	TryConsume(challenge string, expireAt int64) (bool, error)
+	// Close releases any resources held by the store. Calling it again
+	// does nothing.
+	Close() error
+}
+
+// NewChallengeManager creates the replay store selected in the configuration
+func NewChallengeManager(config ServerConfig) (ChallengeManager, error) {
+	switch config.ReplayStore {
+	case "", ReplayStoreMemory:
+		return NewMemoryChallengeManager(config.ExpireTime)
+	case ReplayStoreFile:
+		return NewFileChallengeManager(config.ReplayFile, config.ExpireTime)
+	case ReplayStoreRedis:
+		return NewRedisChallengeManager(config.RedisAddr, config.RedisPass, config.RedisDB, config.RedisPrefix)
+	default:
+		return nil, fmt.Errorf("unknown replay store: %s", config.ReplayStore)
+	}
+}
+
+// MemoryChallengeManager is an in-memory replay store
+type MemoryChallengeManager struct {
+	solvedChallenges *ShardedMap[struct{}]
 	expireDuration   time.Duration
+	done             chan struct{}
+	closeOnce        sync.Once
 }
 
-func NewChallengeManager(expireDuration string) *ChallengeManager {
+// NewMemoryChallengeManager creates an in-memory replay store that removes
+// expired challenges every expireDuration
+func NewMemoryChallengeManager(expireDuration string) (*MemoryChallengeManager, error) {
 	duration, err := time.ParseDuration(expireDuration)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid expire duration: %w", err)
 	}
-	cm := &ChallengeManager{
-		solvedChallenges: make(map[string]int64),
+	cm := &MemoryChallengeManager{
+		solvedChallenges: NewShardedMap[struct{}](0),
 		expireDuration:   duration,
+		done:             make(chan struct{}),
 	}
 	go cm.cleanupLoop()
-	return cm
+	return cm, nil
 }
 
-func (cm *ChallengeManager) AddChallenge(challenge string, expireAt int64) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.solvedChallenges[challenge] = expireAt
+func (cm *MemoryChallengeManager) AddChallenge(challenge string, expireAt int64) error {
+	cm.solvedChallenges.Set(challenge, struct{}{}, replayExpiry(expireAt))
+	return nil
 }
 
-func (cm *ChallengeManager) Exists(challenge string) bool {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	_, ok := cm.solvedChallenges[challenge]
-	if ok {
-		return true
-	}
-	return false
+func (cm *MemoryChallengeManager) Exists(challenge string) (bool, error) {
+	_, ok := cm.solvedChallenges.Get(challenge)
+	return ok, nil
+}
+
+func (cm *MemoryChallengeManager) TryConsume(challenge string, expireAt int64) (bool, error) {
+	return cm.solvedChallenges.SetIfAbsent(challenge, struct{}{}, replayExpiry(expireAt)), nil
+}
+
+func (cm *MemoryChallengeManager) Close() error {
+	cm.closeOnce.Do(func() {
+		close(cm.done)
+	})
+	return nil
 }
 
-func (cm *ChallengeManager) cleanupLoop() {
+func (cm *MemoryChallengeManager) cleanupLoop() {
 	ticker := time.NewTicker(cm.expireDuration)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		cm.cleanupExpired()
+	for {
+		select {
+		case <-ticker.C:
+			cm.cleanupExpired()
+		case <-cm.done:
+			return
+		}
 	}
 }
 
-func (cm *ChallengeManager) cleanupExpired() {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	now := time.Now().UnixNano() / int64(time.Millisecond) //Current time in milliseconds.
-
-	for challenge, val := range cm.solvedChallenges {
-		if val < now {
-			delete(cm.solvedChallenges, challenge)
-			log.Printf("Challenge %s expired and was removed.\n", challenge)
-		}
+func (cm *MemoryChallengeManager) cleanupExpired() {
+	if removed := cm.solvedChallenges.Sweep(time.Now()); removed > 0 {
+		log.Printf("Removed %d expired challenges.", removed)
 	}
 }
+
+// replayExpiry returns when a solved challenge can be forgotten. Challenges
+// stay valid during the second they expire in, so keep them one second longer.
+func replayExpiry(expireAt int64) time.Time {
+	return time.Unix(expireAt+1, 0)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkMemoryChallengeManager measures replay checks and consumes
+// against a store holding many live challenges, with and without the
+// expiry sweep running in the background. The background goroutine keeps
+// adding expired challenges for the sweep to remove, so it takes shard
+// locks throughout the benchmark.
+func BenchmarkMemoryChallengeManager(b *testing.B) {
+	const live = 100000
+	for _, sweeping := range []bool{false, true} {
+		name := "idle"
+		if sweeping {
+			name = "sweeping"
+		}
+		b.Run(name, func(b *testing.B) {
+			cm, err := NewMemoryChallengeManager("1h")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cm.Close()
+			expireAt := time.Now().Add(time.Hour).Unix()
+			for i := 0; i < live; i++ {
+				cm.AddChallenge("live"+strconv.Itoa(i), expireAt)
+			}
+
+			stop := make(chan struct{})
+			var sweeps atomic.Int64
+			var wg sync.WaitGroup
+			if sweeping {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					expired := time.Now().Add(-time.Hour).Unix()
+					for round := 0; ; round++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						for i := 0; i < 10000; i++ {
+							cm.AddChallenge("expired"+strconv.Itoa(round)+"-"+strconv.Itoa(i), expired)
+						}
+						cm.solvedChallenges.Sweep(time.Now())
+						sweeps.Add(1)
+					}
+				}()
+			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					if _, err := cm.Exists("live" + strconv.FormatInt(i%live, 10)); err != nil {
+						b.Error(err)
+					}
+					if _, err := cm.TryConsume("new"+strconv.FormatInt(i, 10), expireAt); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+			if sweeping {
+				b.ReportMetric(float64(sweeps.Load()), "sweeps")
+			}
+		})
+	}
+}
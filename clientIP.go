@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ClientIPContextKey is the context key for the resolved client IP
+	ClientIPContextKey ContextKey = "clientIP"
+)
+
+// DefaultTrustedProxies trusts reverse proxies on the same host only
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// TrustedProxies is a set of networks whose forwarding information is
+// honoured when resolving the client IP
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// ParseTrustedProxies parses a list of CIDR ranges or single IP addresses
+func ParseTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	nets, err := parseNetworks(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// parseNetworks parses CIDR ranges. A single IP address becomes a network
+// holding just that address.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Contains reports whether ip belongs to a trusted proxy
+func (tp *TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipNet := range tp.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP resolves the client IP of a request. Forwarding headers are only
+// used when the immediate peer is a trusted proxy. The forwarding chain is
+// then walked from right to left, and the first address that is not a
+// trusted proxy is the client.
+func (tp *TrustedProxies) ClientIP(r *http.Request) string {
+	client := remoteIP(r)
+	peer := net.ParseIP(client)
+	if peer == nil || !tp.Contains(peer) {
+		return client
+	}
+
+	chain := forwardingChain(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// Obfuscated or garbled entry, keep the last known hop
+			break
+		}
+		client = ip.String()
+		if !tp.Contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// RealIPMiddleware resolves the client IP once and stores it in the request
+// context. RemoteAddr is rewritten too, so request logs show the client.
+func (tp *TrustedProxies) RealIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := tp.ClientIP(r)
+		r.RemoteAddr = ip
+		ctx := context.WithValue(r.Context(), ClientIPContextKey, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// remoteIP returns the IP of the immediate peer
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// If there's an error, just return the RemoteAddr
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// forwardingChain returns the forwarding chain of a request from left to
+// right, with the client first. The standard Forwarded header takes
+// precedence over X-Forwarded-For, which takes precedence over X-Real-IP.
+func forwardingChain(header http.Header) []string {
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		return parseForwarded(values)
+	}
+
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		var chain []string
+		for _, value := range values {
+			for _, ip := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(ip))
+			}
+		}
+		return chain
+	}
+
+	if ip := header.Get("X-Real-IP"); ip != "" {
+		return []string{strings.TrimSpace(ip)}
+	}
+
+	return nil
+}
+
+// parseForwarded extracts the "for" addresses of RFC 7239 Forwarded headers.
+// Ports and the brackets around IPv6 addresses are removed.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			forValue := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					forValue = strings.Trim(val, `"`)
+				}
+			}
+
+			if host, _, err := net.SplitHostPort(forValue); err == nil {
+				forValue = host
+			}
+			chain = append(chain, strings.Trim(forValue, "[]"))
+		}
+	}
+	return chain
+}
+
+// IPKeyer groups client IPs into networks, so a client holding a whole
+// IPv6 block gets a single identity for rate limiting and complexity
+// scaling
+type IPKeyer struct {
+	IPv4Bits int
+	IPv6Bits int
+}
+
+// Key returns the tracking key of an IP: the IP itself, or its network in
+// CIDR notation when a shorter prefix is configured
+func (k IPKeyer) Key(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return prefixKey(v4, k.IPv4Bits, 8*net.IPv4len)
+	}
+	return prefixKey(parsed, k.IPv6Bits, 8*net.IPv6len)
+}
+
+// prefixKey returns the network of ip with the given prefix length
+func prefixKey(ip net.IP, bits, size int) string {
+	if bits <= 0 || bits >= size {
+		return ip.String()
+	}
+	mask := net.CIDRMask(bits, size)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
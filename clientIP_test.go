@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestIPKeyer(t *testing.T) {
+	tests := []struct {
+		keyer IPKeyer
+		ip    string
+		want  string
+	}{
+		{IPKeyer{IPv4Bits: 32, IPv6Bits: 64}, "192.0.2.17", "192.0.2.17"},
+		{IPKeyer{IPv4Bits: 24, IPv6Bits: 64}, "192.0.2.17", "192.0.2.0/24"},
+		{IPKeyer{IPv4Bits: 24, IPv6Bits: 64}, "::ffff:192.0.2.17", "192.0.2.0/24"},
+		{IPKeyer{IPv4Bits: 32, IPv6Bits: 64}, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{IPKeyer{IPv4Bits: 32, IPv6Bits: 56}, "2001:db8:1:2ff:3:4:5:6", "2001:db8:1:200::/56"},
+		{IPKeyer{IPv4Bits: 32, IPv6Bits: 128}, "2001:db8::1", "2001:db8::1"},
+		{IPKeyer{IPv4Bits: 24, IPv6Bits: 64}, "not an ip", "not an ip"},
+	}
+	for _, tt := range tests {
+		if got := tt.keyer.Key(tt.ip); got != tt.want {
+			t.Errorf("%+v.Key(%q) = %q, want %q", tt.keyer, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"127.0.0.0/8", "::1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		peer   string
+		header map[string][]string
+		want   string
+	}{
+		{"no headers", "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"untrusted peer spoofing XFF", "203.0.113.9:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "203.0.113.9"},
+		{"untrusted peer spoofing Forwarded", "203.0.113.9:1234", map[string][]string{"Forwarded": {"for=198.51.100.7"}}, "203.0.113.9"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.9:1234", map[string][]string{"X-Real-IP": {"198.51.100.7"}}, "203.0.113.9"},
+		{"trusted peer", "127.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"trusted IPv6 peer", "[::1]:1234", map[string][]string{"X-Forwarded-For": {"2001:db8::7"}}, "2001:db8::7"},
+		{"walk stops at the first untrusted hop", "127.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"192.0.2.1, 198.51.100.7, 10.0.0.2"}}, "198.51.100.7"},
+		{"XFF over several lines", "127.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"192.0.2.1", "198.51.100.7, 10.0.0.2"}}, "198.51.100.7"},
+		{"only trusted hops", "127.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"garbled last entry", "127.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage"}}, "127.0.0.1"},
+		{"garbled entry behind a trusted hop", "127.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.7, not-an-ip, 10.0.0.2"}}, "10.0.0.2"},
+		{"empty entry", "127.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.7,"}}, "127.0.0.1"},
+		{"IP with port in XFF", "127.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.7:80"}}, "127.0.0.1"},
+		{"X-Real-IP", "127.0.0.1:1234", map[string][]string{"X-Real-IP": {" 198.51.100.7 "}}, "198.51.100.7"},
+		{"Forwarded takes precedence", "127.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"192.0.2.1"}}, "198.51.100.7"},
+		{"Forwarded quoted IPv6 with port", "127.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"Forwarded quoted IPv6", "127.0.0.1:1234", map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]"`}}, "2001:db8:cafe::17"},
+		{"Forwarded IPv4 with port", "127.0.0.1:1234", map[string][]string{"Forwarded": {`for="198.51.100.7:8080"`}}, "198.51.100.7"},
+		{"Forwarded with parameters", "127.0.0.1:1234",
+			map[string][]string{"Forwarded": {"proto=https;For=198.51.100.7;by=10.0.0.2, for=10.0.0.2"}}, "198.51.100.7"},
+		{"Forwarded obfuscated hop", "127.0.0.1:1234", map[string][]string{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{"Forwarded unknown", "127.0.0.1:1234", map[string][]string{"Forwarded": {"for=unknown"}}, "127.0.0.1"},
+		{"Forwarded without for", "127.0.0.1:1234", map[string][]string{"Forwarded": {"proto=https"}}, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		for name, values := range tt.header {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		if got := trusted.ClientIP(req); got != tt.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	got := parseForwarded([]string{
+		`for=192.0.2.43, for="[2001:db8:cafe::17]:4711"`,
+		`for=198.51.100.17;proto=http;by=203.0.113.43`,
+		`proto=https`,
+	})
+	want := []string{"192.0.2.43", "2001:db8:cafe::17", "198.51.100.17", ""}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseForwarded = %q, want %q", got, want)
+	}
+}
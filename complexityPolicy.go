@@ -0,0 +1,524 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// PolicyPerIP raises complexity for IPs that request many challenges
+	PolicyPerIP = "perIP"
+	// PolicyGlobalRate raises complexity when the whole server is busy
+	PolicyGlobalRate = "globalRate"
+	// PolicyFailureRatio raises complexity for API keys with many failed
+	// verifications
+	PolicyFailureRatio = "failureRatio"
+	// PolicyBounds keeps complexity between a floor and a ceiling
+	PolicyBounds = "bounds"
+	// PolicyLoad moves complexity between a minimum and a maximum as the
+	// challenge rate of the server or an API key rises and falls
+	PolicyLoad = "load"
+	// PolicyFailures raises complexity after failed and replayed
+	// verifications, decaying back over time
+	PolicyFailures = "failures"
+
+	// ScopeGlobal applies a policy to the whole server
+	ScopeGlobal = "global"
+	// ScopeIP applies a policy to each client IP separately
+	ScopeIP = "ip"
+	// ScopeAPIKey applies a policy to each API key separately
+	ScopeAPIKey = "apiKey"
+
+	// failureMemory is how many half-lives a failure score is kept after
+	// the last failure, by which time it has decayed below 1/256
+	failureMemory = 8
+
+	// defaultFailureRatioWindow is how far back the failure ratio policy
+	// counts verifications when no window is set
+	defaultFailureRatioWindow = time.Hour
+
+	// maxScaledComplexity caps the complexity policies scale up to, so
+	// large factors can't overflow. Solving such challenges already takes
+	// clients minutes.
+	maxScaledComplexity = 100_000_000
+)
+
+// ComplexityRequest describes a challenge request being priced
+type ComplexityRequest struct {
+	APIKey string
+	IP     string // Client IP, grouped by IPKeyer, or empty if unknown
+	Now    time.Time
+}
+
+// ComplexityPolicy adjusts the maximum number of a challenge. Policies are
+// applied in order, each one starting from the result of the previous. Adjust
+// is called once per issued challenge, so policies may count requests in it.
+type ComplexityPolicy interface {
+	Adjust(req ComplexityRequest, complexity int64) int64
+}
+
+// FailureObserver is implemented by policies that react to failed and
+// replayed verifications
+type FailureObserver interface {
+	ObserveFailure(req ComplexityRequest)
+}
+
+// SuccessObserver is implemented by policies that react to successful
+// verifications
+type SuccessObserver interface {
+	ObserveSuccess(req ComplexityRequest)
+}
+
+// sweeper is implemented by policies keeping per-client state, so expired
+// entries can be removed periodically
+type sweeper interface {
+	Sweep(now time.Time)
+}
+
+// ComplexityPolicyConfig configures one complexity policy. Which fields are
+// used depends on the type.
+type ComplexityPolicyConfig struct {
+	Type       string  `mapstructure:"type" json:"type" yaml:"type"`
+	Window     string  `mapstructure:"window" json:"window,omitempty" yaml:"window,omitempty"`
+	Threshold  float64 `mapstructure:"threshold" json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	Step       int64   `mapstructure:"step" json:"step,omitempty" yaml:"step,omitempty"`
+	Increase   float64 `mapstructure:"increase" json:"increase,omitempty" yaml:"increase,omitempty"`
+	MinSamples int64   `mapstructure:"minSamples" json:"minSamples,omitempty" yaml:"minSamples,omitempty"`
+	Min        int64   `mapstructure:"min" json:"min,omitempty" yaml:"min,omitempty"`
+	Max        int64   `mapstructure:"max" json:"max,omitempty" yaml:"max,omitempty"`
+	Scope      string  `mapstructure:"scope" json:"scope,omitempty" yaml:"scope,omitempty"`
+	Low        float64 `mapstructure:"low" json:"low,omitempty" yaml:"low,omitempty"`
+	High       float64 `mapstructure:"high" json:"high,omitempty" yaml:"high,omitempty"`
+	HalfLife   string  `mapstructure:"halfLife" json:"halfLife,omitempty" yaml:"halfLife,omitempty"`
+}
+
+// DefaultComplexityPolicies returns the policies used when none are
+// configured: +10% for every 10 challenges once an IP has requested more
+// than 10 within 5 minutes of each other, +20% for each recent failed
+// verification of the IP, halving every 10 minutes, and up to 200000 as
+// the server issues from 1000 to 10000 challenges a minute, which per-IP
+// rules miss when a flood comes from many IPs
+func DefaultComplexityPolicies() []ComplexityPolicyConfig {
+	return []ComplexityPolicyConfig{
+		{Type: PolicyPerIP, Window: "5m", Threshold: 10, Step: 10, Increase: 0.1},
+		{Type: PolicyFailures, Scope: ScopeIP, HalfLife: "10m", Increase: 0.2},
+		{Type: PolicyLoad, Scope: ScopeGlobal, Window: "1m", Low: 1000, High: 10000, Max: 4 * DefaultComplexity},
+	}
+}
+
+// validate checks the settings used by the policy type
+func (c ComplexityPolicyConfig) validate() error {
+	switch c.Type {
+	case PolicyPerIP, PolicyGlobalRate:
+		if window, err := time.ParseDuration(c.Window); err != nil || window <= 0 {
+			return fmt.Errorf("%s policy needs a positive window", c.Type)
+		}
+		if c.Type == PolicyPerIP && c.Step < 1 {
+			return fmt.Errorf("%s policy needs a step of at least 1", c.Type)
+		}
+		if c.Type == PolicyGlobalRate && c.Threshold <= 0 {
+			return fmt.Errorf("%s policy needs a positive threshold", c.Type)
+		}
+	case PolicyFailureRatio:
+		if window, err := time.ParseDuration(c.Window); c.Window != "" && (err != nil || window <= 0) {
+			return fmt.Errorf("%s policy window must be positive", c.Type)
+		}
+		if c.Threshold < 0 || c.Threshold >= 1 {
+			return fmt.Errorf("%s policy threshold must be between 0 and 1", c.Type)
+		}
+	case PolicyBounds:
+		if c.Min < 0 || c.Max < 0 || (c.Max > 0 && c.Min > c.Max) {
+			return fmt.Errorf("%s policy needs 0 <= min <= max", c.Type)
+		}
+		return nil
+	case PolicyLoad:
+		if window, err := time.ParseDuration(c.Window); err != nil || window <= 0 {
+			return fmt.Errorf("%s policy needs a positive window", c.Type)
+		}
+		if c.Scope != "" && c.Scope != ScopeGlobal && c.Scope != ScopeAPIKey {
+			return fmt.Errorf("%s policy scope must be %s or %s", c.Type, ScopeGlobal, ScopeAPIKey)
+		}
+		if c.Low < 0 || c.High <= c.Low {
+			return fmt.Errorf("%s policy needs 0 <= low < high", c.Type)
+		}
+		if c.Max <= 0 || c.Min < 0 || c.Min > c.Max {
+			return fmt.Errorf("%s policy needs 0 <= min <= max, with max set", c.Type)
+		}
+		return nil
+	case PolicyFailures:
+		if halfLife, err := time.ParseDuration(c.HalfLife); err != nil || halfLife <= 0 {
+			return fmt.Errorf("%s policy needs a positive halfLife", c.Type)
+		}
+		if c.Scope != "" && c.Scope != ScopeIP && c.Scope != ScopeAPIKey {
+			return fmt.Errorf("%s policy scope must be %s or %s", c.Type, ScopeIP, ScopeAPIKey)
+		}
+	default:
+		return fmt.Errorf("unknown complexity policy: %s", c.Type)
+	}
+	if c.Increase < 0 {
+		return fmt.Errorf("%s policy increase must not be negative", c.Type)
+	}
+	return nil
+}
+
+// validatePolicies checks a list of policies. The per-IP policy counts
+// requests in the activity shared with the server, so it may only be used
+// once.
+func validatePolicies(configs []ComplexityPolicyConfig) error {
+	perIP := false
+	for _, c := range configs {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.Type == PolicyPerIP {
+			if perIP {
+				return fmt.Errorf("%s policy may only be used once", c.Type)
+			}
+			perIP = true
+		}
+	}
+	return nil
+}
+
+// NewComplexityPolicies creates the configured policies. The per-IP policy
+// counts requests in activity. Policies tracking clients keep at most maxIPs
+// entries, 0 meaning unbounded.
+func NewComplexityPolicies(configs []ComplexityPolicyConfig, activity *ShardedMap[ipActivity], maxIPs int) ([]ComplexityPolicy, error) {
+	if err := validatePolicies(configs); err != nil {
+		return nil, err
+	}
+
+	policies := make([]ComplexityPolicy, 0, len(configs))
+	for _, c := range configs {
+		window, _ := time.ParseDuration(c.Window)
+
+		switch c.Type {
+		case PolicyPerIP:
+			policies = append(policies, &ipFrequencyPolicy{
+				activity:  activity,
+				window:    window,
+				threshold: int64(c.Threshold),
+				step:      c.Step,
+				increase:  c.Increase,
+			})
+		case PolicyGlobalRate:
+			policies = append(policies, &globalRatePolicy{
+				window:    window,
+				threshold: c.Threshold,
+				increase:  c.Increase,
+			})
+		case PolicyFailureRatio:
+			if window == 0 {
+				window = defaultFailureRatioWindow
+			}
+			policies = append(policies, &failureRatioPolicy{
+				counts:     NewShardedMap[verificationCount](0),
+				window:     window,
+				threshold:  c.Threshold,
+				minSamples: c.MinSamples,
+				increase:   c.Increase,
+			})
+		case PolicyBounds:
+			policies = append(policies, boundsPolicy{min: c.Min, max: c.Max})
+		case PolicyLoad:
+			policy := &loadPolicy{
+				window: window,
+				low:    c.Low,
+				high:   c.High,
+				min:    c.Min,
+				max:    c.Max,
+			}
+			if c.Scope == ScopeAPIKey {
+				policy.keys = NewShardedMap[windowCount](0)
+			}
+			policies = append(policies, policy)
+		case PolicyFailures:
+			halfLife, _ := time.ParseDuration(c.HalfLife)
+			policies = append(policies, &failurePolicy{
+				scores:   NewShardedMap[failureScore](maxIPs),
+				byKey:    c.Scope == ScopeAPIKey,
+				halfLife: halfLife,
+				increase: c.Increase,
+			})
+		}
+	}
+	return policies, nil
+}
+
+// scale multiplies a complexity by factor, up to maxScaledComplexity or the
+// complexity itself if that is higher
+func scale(complexity int64, factor float64) int64 {
+	scaled := float64(complexity) * factor
+	if scaled > maxScaledComplexity {
+		return max(complexity, maxScaledComplexity)
+	}
+	return int64(scaled)
+}
+
+// ipFrequencyPolicy adds increase for every step challenges once an IP has
+// requested more than threshold. The count resets once the IP has been quiet
+// for window.
+type ipFrequencyPolicy struct {
+	activity  *ShardedMap[ipActivity]
+	window    time.Duration
+	threshold int64
+	step      int64
+	increase  float64
+}
+
+func (p *ipFrequencyPolicy) Adjust(req ComplexityRequest, complexity int64) int64 {
+	var count int64
+	p.activity.Update(req.IP, func(activity ipActivity, _ bool) (ipActivity, time.Time) {
+		if req.Now.Sub(activity.LastRequest) >= p.window {
+			activity.Count = 0
+		}
+		count = activity.Count
+		activity.Count++
+		activity.LastRequest = req.Now
+		return activity, req.Now.Add(p.window)
+	})
+
+	if count > p.threshold {
+		return scale(complexity, 1.0+float64(count/p.step)*p.increase)
+	}
+	return complexity
+}
+
+// globalRatePolicy scales complexity with the number of challenges issued by
+// the server within window. At twice the threshold, complexity rises by
+// increase, at three times by twice increase, and so on.
+type globalRatePolicy struct {
+	mu        sync.Mutex
+	count     windowCount
+	window    time.Duration
+	threshold float64
+	increase  float64
+}
+
+func (p *globalRatePolicy) Adjust(req ComplexityRequest, complexity int64) int64 {
+	p.mu.Lock()
+	rate := p.count.add(req.Now, p.window)
+	p.mu.Unlock()
+
+	if rate > p.threshold {
+		return scale(complexity, 1.0+(rate/p.threshold-1.0)*p.increase)
+	}
+	return complexity
+}
+
+// failureRatioPolicy scales complexity for API keys whose share of failed
+// verifications within window is above threshold, reaching 1+increase times
+// the complexity when every verification fails
+type failureRatioPolicy struct {
+	counts     *ShardedMap[verificationCount]
+	window     time.Duration
+	threshold  float64
+	minSamples int64
+	increase   float64
+}
+
+// verificationCount counts the recent verifications of an API key
+type verificationCount struct {
+	Failed windowCount
+	Total  windowCount
+}
+
+func (p *failureRatioPolicy) Adjust(req ComplexityRequest, complexity int64) int64 {
+	counts, _ := p.counts.Get(req.APIKey)
+	failed := counts.Failed.at(req.Now, p.window)
+	total := counts.Total.at(req.Now, p.window)
+	if total == 0 || total < float64(p.minSamples) {
+		return complexity
+	}
+
+	ratio := failed / total
+	if ratio > p.threshold {
+		return scale(complexity, 1.0+(ratio-p.threshold)/(1.0-p.threshold)*p.increase)
+	}
+	return complexity
+}
+
+func (p *failureRatioPolicy) ObserveFailure(req ComplexityRequest) {
+	p.observe(req, true)
+}
+
+func (p *failureRatioPolicy) ObserveSuccess(req ComplexityRequest) {
+	p.observe(req, false)
+}
+
+// observe counts a verification of the API key
+func (p *failureRatioPolicy) observe(req ComplexityRequest, failed bool) {
+	p.counts.Update(req.APIKey, func(counts verificationCount, _ bool) (verificationCount, time.Time) {
+		counts.Total.add(req.Now, p.window)
+		if failed {
+			counts.Failed.add(req.Now, p.window)
+		}
+		return counts, req.Now.Add(2 * p.window)
+	})
+}
+
+func (p *failureRatioPolicy) Sweep(now time.Time) {
+	p.counts.Sweep(now)
+}
+
+// boundsPolicy clamps complexity to [min, max], where 0 means unbounded
+type boundsPolicy struct {
+	min int64
+	max int64
+}
+
+func (p boundsPolicy) Adjust(_ ComplexityRequest, complexity int64) int64 {
+	if p.min > 0 && complexity < p.min {
+		return p.min
+	}
+	if p.max > 0 && complexity > p.max {
+		return p.max
+	}
+	return complexity
+}
+
+// loadPolicy interpolates complexity between min and max as the challenge
+// rate within window goes from low to high. A min of 0 starts from the
+// complexity set by earlier policies, and the result is never lower than
+// that complexity.
+type loadPolicy struct {
+	mu     sync.Mutex
+	global windowCount
+	keys   *ShardedMap[windowCount] // Per API key, nil for the global scope
+	window time.Duration
+	low    float64
+	high   float64
+	min    int64
+	max    int64
+}
+
+func (p *loadPolicy) Adjust(req ComplexityRequest, complexity int64) int64 {
+	rate := p.rate(req)
+
+	floor := p.min
+	if floor == 0 {
+		floor = complexity
+	}
+	load := math.Min(1.0, math.Max(0.0, (rate-p.low)/(p.high-p.low)))
+	if target := floor + int64(float64(p.max-floor)*load); target > complexity {
+		return target
+	}
+	return complexity
+}
+
+// rate counts a challenge and returns the number issued within window
+func (p *loadPolicy) rate(req ComplexityRequest) float64 {
+	if p.keys == nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.global.add(req.Now, p.window)
+	}
+
+	var rate float64
+	p.keys.Update(req.APIKey, func(count windowCount, _ bool) (windowCount, time.Time) {
+		rate = count.add(req.Now, p.window)
+		return count, req.Now.Add(2 * p.window)
+	})
+	return rate
+}
+
+// failurePolicy adds increase for every recent failed or replayed
+// verification of an IP or API key. Each failure counts for half as much
+// after every halfLife.
+type failurePolicy struct {
+	scores   *ShardedMap[failureScore]
+	byKey    bool
+	halfLife time.Duration
+	increase float64
+}
+
+// failureScore is a failure count decaying exponentially since UpdatedAt
+type failureScore struct {
+	Score     float64
+	UpdatedAt time.Time
+}
+
+// at returns the score decayed until now
+func (s failureScore) at(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(s.UpdatedAt)
+	if elapsed <= 0 {
+		return s.Score
+	}
+	return s.Score * math.Exp2(-float64(elapsed)/float64(halfLife))
+}
+
+func (p *failurePolicy) Adjust(req ComplexityRequest, complexity int64) int64 {
+	score, ok := p.scores.Get(p.key(req))
+	if !ok {
+		return complexity
+	}
+	return scale(complexity, 1.0+score.at(req.Now, p.halfLife)*p.increase)
+}
+
+func (p *failurePolicy) ObserveFailure(req ComplexityRequest) {
+	if !p.byKey && req.IP == "" {
+		return // The client is unknown, so no IP is charged
+	}
+	p.scores.Update(p.key(req), func(score failureScore, _ bool) (failureScore, time.Time) {
+		score.Score = score.at(req.Now, p.halfLife) + 1
+		score.UpdatedAt = req.Now
+		return score, req.Now.Add(failureMemory * p.halfLife)
+	})
+}
+
+func (p *failurePolicy) Sweep(now time.Time) {
+	p.scores.Sweep(now)
+}
+
+// key returns the client a request is scored for
+func (p *failurePolicy) key(req ComplexityRequest) string {
+	if p.byKey {
+		return req.APIKey
+	}
+	return req.IP
+}
+
+// windowCount counts events in a sliding window. The count is estimated from
+// the current fixed window and the previous one, weighted by how much of it
+// still overlaps the sliding window.
+type windowCount struct {
+	Start    time.Time
+	Current  float64
+	Previous float64
+}
+
+// add counts an event at now and returns the number of events in the window
+// ending at now
+func (c *windowCount) add(now time.Time, window time.Duration) float64 {
+	c.roll(now, window)
+	c.Current++
+	return c.value(now, window)
+}
+
+// at returns the number of events in the window ending at now, without
+// counting one
+func (c windowCount) at(now time.Time, window time.Duration) float64 {
+	c.roll(now, window)
+	return c.value(now, window)
+}
+
+// roll moves the fixed windows forward so that the current one contains now
+func (c *windowCount) roll(now time.Time, window time.Duration) {
+	elapsed := now.Sub(c.Start)
+	switch {
+	case c.Start.IsZero() || elapsed >= 2*window || elapsed < 0:
+		*c = windowCount{Start: now.Truncate(window)}
+	case elapsed >= window:
+		c.Previous, c.Current = c.Current, 0
+		c.Start = c.Start.Add(window)
+	}
+}
+
+// value estimates the events in the sliding window ending at now, once the
+// fixed windows have been rolled forward to now
+func (c *windowCount) value(now time.Time, window time.Duration) float64 {
+	overlap := 1.0 - float64(now.Sub(c.Start))/float64(window)
+	return c.Previous*overlap + c.Current
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	eventChallenge = "challenge"
+	eventFailure   = "failure"
+	eventSuccess   = "success"
+)
+
+// policyEvent is one event of a synthetic request stream
+type policyEvent struct {
+	kind   string
+	at     time.Duration // Since the start of the stream
+	ip     string
+	apiKey string
+}
+
+// events returns n events of a kind, every apart starting at from
+func events(kind string, n int, from, every time.Duration, ip, apiKey string) []policyEvent {
+	stream := make([]policyEvent, n)
+	for i := range stream {
+		stream[i] = policyEvent{kind: kind, at: from + time.Duration(i)*every, ip: ip, apiKey: apiKey}
+	}
+	return stream
+}
+
+// repeat returns n copies of complexity
+func repeat(n int, complexity int64) []int64 {
+	return slices.Repeat([]int64{complexity}, n)
+}
+
+func TestComplexityPolicies(t *testing.T) {
+	const base = 1000
+	perIP := DefaultComplexityPolicies()[0]
+	failureRatio := ComplexityPolicyConfig{Type: PolicyFailureRatio, Window: "1h", Threshold: 0.5, MinSamples: 4, Increase: 1}
+
+	tests := []struct {
+		name     string
+		policies []ComplexityPolicyConfig
+		stream   [][]policyEvent
+		want     []int64 // Complexity of each challenge in the stream
+	}{
+		{
+			name:     "perIP raises complexity past the threshold",
+			policies: []ComplexityPolicyConfig{perIP},
+			stream:   [][]policyEvent{events(eventChallenge, 12, 0, time.Second, "a", "k")},
+			want:     append(repeat(11, base), 1100),
+		},
+		{
+			name:     "perIP resets after a quiet window",
+			policies: []ComplexityPolicyConfig{perIP},
+			stream: [][]policyEvent{
+				events(eventChallenge, 12, 0, time.Second, "a", "k"),
+				events(eventChallenge, 1, 6*time.Minute, 0, "a", "k"),
+			},
+			want: append(repeat(11, base), 1100, base),
+		},
+		{
+			name:     "perIP counts IPs separately",
+			policies: []ComplexityPolicyConfig{perIP},
+			stream: [][]policyEvent{
+				events(eventChallenge, 12, 0, time.Second, "a", "k"),
+				events(eventChallenge, 1, 12*time.Second, 0, "b", "k"),
+			},
+			want: append(repeat(11, base), 1100, base),
+		},
+		{
+			name:     "globalRate scales with multiples of the threshold",
+			policies: []ComplexityPolicyConfig{{Type: PolicyGlobalRate, Window: "1m", Threshold: 4, Increase: 1}},
+			stream: [][]policyEvent{
+				events(eventChallenge, 4, 0, time.Second, "a", "k"),
+				events(eventChallenge, 4, 4*time.Second, time.Second, "b", "l"),
+			},
+			want: []int64{base, base, base, base, 1250, 1500, 1750, 2000},
+		},
+		{
+			name:     "failureRatio raises complexity for the failing key",
+			policies: []ComplexityPolicyConfig{failureRatio},
+			stream: [][]policyEvent{
+				events(eventSuccess, 2, 0, time.Second, "a", "k"),
+				events(eventFailure, 6, 2*time.Second, time.Second, "a", "k"),
+				events(eventChallenge, 1, 10*time.Second, 0, "a", "k"),
+				events(eventChallenge, 1, 10*time.Second, 0, "a", "l"),
+			},
+			want: []int64{1500, base},
+		},
+		{
+			name:     "failureRatio waits for minSamples",
+			policies: []ComplexityPolicyConfig{failureRatio},
+			stream: [][]policyEvent{
+				events(eventFailure, 3, 0, time.Second, "a", "k"),
+				events(eventChallenge, 1, 3*time.Second, 0, "a", "k"),
+			},
+			want: []int64{base},
+		},
+		{
+			name:     "failureRatio forgets failures outside the window",
+			policies: []ComplexityPolicyConfig{failureRatio},
+			stream: [][]policyEvent{
+				events(eventFailure, 8, 0, time.Second, "a", "k"),
+				events(eventChallenge, 1, 10*time.Second, 0, "a", "k"),
+				// Half of the previous window still overlaps the sliding one
+				events(eventChallenge, 1, 90*time.Minute, 0, "a", "k"),
+				events(eventSuccess, 4, 90*time.Minute, 0, "a", "k"),
+				events(eventChallenge, 1, 90*time.Minute, 0, "a", "k"),
+				events(eventChallenge, 1, 3*time.Hour, 0, "a", "k"),
+			},
+			want: []int64{2000, 2000, base, base},
+		},
+		{
+			name:     "bounds raises to the floor",
+			policies: []ComplexityPolicyConfig{{Type: PolicyBounds, Min: 2000}},
+			stream:   [][]policyEvent{events(eventChallenge, 1, 0, 0, "a", "k")},
+			want:     []int64{2000},
+		},
+		{
+			name:     "bounds lowers to the ceiling",
+			policies: []ComplexityPolicyConfig{{Type: PolicyBounds, Max: 500}},
+			stream:   [][]policyEvent{events(eventChallenge, 1, 0, 0, "a", "k")},
+			want:     []int64{500},
+		},
+		{
+			name:     "load interpolates between low and high",
+			policies: []ComplexityPolicyConfig{{Type: PolicyLoad, Window: "1m", Low: 2, High: 6, Max: 2000}},
+			stream:   [][]policyEvent{events(eventChallenge, 7, 0, time.Second, "a", "k")},
+			want:     []int64{base, base, 1250, 1500, 1750, 2000, 2000},
+		},
+		{
+			name:     "load counts API keys separately",
+			policies: []ComplexityPolicyConfig{{Type: PolicyLoad, Scope: ScopeAPIKey, Window: "1m", Low: 0, High: 2, Max: 2000}},
+			stream: [][]policyEvent{
+				events(eventChallenge, 1, 0, 0, "a", "k"),
+				events(eventChallenge, 1, time.Second, 0, "a", "l"),
+				events(eventChallenge, 1, 2*time.Second, 0, "a", "k"),
+			},
+			want: []int64{1500, 1500, 2000},
+		},
+		{
+			name:     "failures raise complexity per IP and decay",
+			policies: []ComplexityPolicyConfig{DefaultComplexityPolicies()[1]},
+			stream: [][]policyEvent{
+				events(eventFailure, 2, 0, 0, "a", "k"),
+				events(eventChallenge, 1, 0, 0, "a", "k"),
+				events(eventChallenge, 1, 0, 0, "b", "k"),
+				events(eventChallenge, 1, 10*time.Minute, 0, "a", "k"),
+			},
+			want: []int64{1400, base, 1200},
+		},
+		{
+			name:     "failures raise complexity per API key",
+			policies: []ComplexityPolicyConfig{{Type: PolicyFailures, Scope: ScopeAPIKey, HalfLife: "10m", Increase: 0.2}},
+			stream: [][]policyEvent{
+				events(eventFailure, 1, 0, 0, "a", "k"),
+				events(eventChallenge, 1, 0, 0, "b", "k"),
+				events(eventChallenge, 1, 0, 0, "a", "l"),
+			},
+			want: []int64{1200, base},
+		},
+		{
+			name:     "failures can't overflow complexity",
+			policies: []ComplexityPolicyConfig{{Type: PolicyFailures, Scope: ScopeIP, HalfLife: "10m", Increase: 1e15}},
+			stream: [][]policyEvent{
+				events(eventFailure, 50000, 0, 0, "a", "k"),
+				events(eventChallenge, 1, 0, 0, "a", "k"),
+			},
+			want: []int64{maxScaledComplexity},
+		},
+		{
+			name:     "policies apply in order",
+			policies: []ComplexityPolicyConfig{perIP, {Type: PolicyBounds, Max: 1050}},
+			stream:   [][]policyEvent{events(eventChallenge, 12, 0, time.Second, "a", "k")},
+			want:     append(repeat(11, base), 1050),
+		},
+	}
+
+	// Entries expire by the wall clock, so the stream starts in the future
+	start := time.Now().Truncate(time.Hour).Add(time.Hour)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := NewComplexityPolicies(tt.policies, NewShardedMap[ipActivity](0), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int64
+			for _, event := range slices.Concat(tt.stream...) {
+				req := ComplexityRequest{APIKey: event.apiKey, IP: event.ip, Now: start.Add(event.at)}
+				switch event.kind {
+				case eventChallenge:
+					complexity := int64(base)
+					for _, policy := range policies {
+						complexity = policy.Adjust(req, complexity)
+					}
+					got = append(got, complexity)
+				case eventFailure:
+					for _, policy := range policies {
+						if observer, ok := policy.(FailureObserver); ok {
+							observer.ObserveFailure(req)
+						}
+					}
+				case eventSuccess:
+					for _, policy := range policies {
+						if observer, ok := policy.(SuccessObserver); ok {
+							observer.ObserveSuccess(req)
+						}
+					}
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("complexities = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultPoliciesSlowDistributedFloods(t *testing.T) {
+	policies, err := NewComplexityPolicies(DefaultComplexityPolicies(), NewShardedMap[ipActivity](0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every challenge comes from another IP, so no per-IP rule applies
+	start := time.Now().Truncate(time.Hour).Add(time.Hour)
+	var got []int64
+	for i := range 12000 {
+		req := ComplexityRequest{APIKey: "k", IP: "ip" + strconv.Itoa(i), Now: start.Add(time.Duration(i) * 5 * time.Millisecond)}
+		complexity := int64(DefaultComplexity)
+		for _, policy := range policies {
+			complexity = policy.Adjust(req, complexity)
+		}
+		got = append(got, complexity)
+	}
+	if got[999] != DefaultComplexity || got[5499] <= DefaultComplexity || got[11999] != 4*DefaultComplexity {
+		t.Errorf("complexity after 1000, 5500 and 12000 challenges = %d, %d, %d; want %d, more, %d",
+			got[999], got[5499], got[11999], DefaultComplexity, 4*DefaultComplexity)
+	}
+}
+
+func TestScale(t *testing.T) {
+	tests := []struct {
+		complexity int64
+		factor     float64
+		want       int64
+	}{
+		{1000, 1.5, 1500},
+		{50000, 1e15, maxScaledComplexity},
+		{50000, math.Inf(1), maxScaledComplexity},
+		{2 * maxScaledComplexity, 2, 2 * maxScaledComplexity},
+	}
+	for _, tt := range tests {
+		if got := scale(tt.complexity, tt.factor); got != tt.want {
+			t.Errorf("scale(%d, %g) = %d, want %d", tt.complexity, tt.factor, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePolicies(t *testing.T) {
+	failures := DefaultComplexityPolicies()[1]
+	tests := []struct {
+		name     string
+		policies []ComplexityPolicyConfig
+		wantErr  bool
+	}{
+		{"defaults", DefaultComplexityPolicies(), false},
+		{"empty", nil, false},
+		{"repeated failures", []ComplexityPolicyConfig{failures, failures}, false},
+		{"repeated perIP", append(DefaultComplexityPolicies(), DefaultComplexityPolicies()[0]), true},
+		{"unknown type", []ComplexityPolicyConfig{{Type: "random"}}, true},
+		{"negative failureRatio window", []ComplexityPolicyConfig{{Type: PolicyFailureRatio, Window: "-1h"}}, true},
+	}
+	for _, tt := range tests {
+		if err := validatePolicies(tt.policies); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePolicies() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,42 +18,73 @@ const (
 	DefaultPort       = 8080
 	DefaultComplexity = 50000
 	DefaultExpireTime = "5m"
+	DefaultReplay     = ReplayStoreMemory
+	DefaultReplayFile = "./verity.replay"
+	DefaultRedisAddr  = "127.0.0.1:6379"
+	DefaultRedisKey   = "verity:replay:"
+	DefaultMaxIPs     = 100000
+	DefaultIPStatsTTL = "24h"
+	DefaultRateLimit  = "100/10m"
+	DefaultBurst      = 20
+	DefaultIPv4Prefix = 32
+	DefaultIPv6Prefix = 64
+	DefaultMaxBody    = 64 << 10
 	EnvPrefix         = "VERITY"
 )
 
 // ServerConfig holds the application configuration
 type ServerConfig struct {
-	Addr       string                `mapstructure:"addr" json:"addr"`
-	Port       int                   `mapstructure:"port" json:"port"`
-	HMACKey    string                `mapstructure:"hmacKey" json:"hmacKey"`
-	Algorithm  altcha.Algorithm      `mapstructure:"algorithm" json:"algorithm"`
-	Complexity int64                 `mapstructure:"complexity" json:"complexity"`
-	ExpireTime string                `mapstructure:"expireTime" json:"expireTime"`
-	APIKeys    map[string][]string   `mapstructure:"apiKeys" json:"apiKeys"`
-	Stats      map[string]StatsEntry `mapstructure:"stats" json:"stats"`
+	Addr           string                   `mapstructure:"addr" json:"addr"`
+	Port           int                      `mapstructure:"port" json:"port"`
+	HMACKey        string                   `mapstructure:"hmacKey" json:"hmacKey"`
+	Algorithm      altcha.Algorithm         `mapstructure:"algorithm" json:"algorithm"`
+	Complexity     int64                    `mapstructure:"complexity" json:"complexity"`
+	ExpireTime     string                   `mapstructure:"expireTime" json:"expireTime"`
+	ReplayStore    string                   `mapstructure:"replayStore" json:"replayStore"`
+	ReplayFile     string                   `mapstructure:"replayFile" json:"replayFile"`
+	RedisAddr      string                   `mapstructure:"redisAddr" json:"redisAddr"`
+	RedisPass      string                   `mapstructure:"redisPassword" json:"redisPassword"`
+	RedisDB        int                      `mapstructure:"redisDB" json:"redisDB"`
+	RedisPrefix    string                   `mapstructure:"redisPrefix" json:"redisPrefix"`
+	MaxIPs         int                      `mapstructure:"maxTrackedIPs" json:"maxTrackedIPs"`
+	IPStatsTTL     string                   `mapstructure:"ipStatsTTL" json:"ipStatsTTL"`
+	ChallengeRate  string                   `mapstructure:"challengeRateLimit" json:"challengeRateLimit"`
+	ChallengeBurst int                      `mapstructure:"challengeBurst" json:"challengeBurst"`
+	VerifyRate     string                   `mapstructure:"verifyRateLimit" json:"verifyRateLimit"`
+	VerifyBurst    int                      `mapstructure:"verifyBurst" json:"verifyBurst"`
+	TrustedProxies []string                 `mapstructure:"trustedProxies" json:"trustedProxies"`
+	ProxyProtocol  bool                     `mapstructure:"proxyProtocol" json:"proxyProtocol"`
+	IPv4Prefix     int                      `mapstructure:"ipv4Prefix" json:"ipv4Prefix"`
+	IPv6Prefix     int                      `mapstructure:"ipv6Prefix" json:"ipv6Prefix"`
+	AllowList      []string                 `mapstructure:"allowList" json:"allowList"`
+	AllowListFile  string                   `mapstructure:"allowListFile" json:"allowListFile"`
+	DenyList       []string                 `mapstructure:"denyList" json:"denyList"`
+	DenyListFile   string                   `mapstructure:"denyListFile" json:"denyListFile"`
+	APIKeySources  []string                 `mapstructure:"apiKeySources" json:"apiKeySources"`
+	LegacyV1       bool                     `mapstructure:"legacyV1Responses" json:"legacyV1Responses"`
+	MaxBodyBytes   int64                    `mapstructure:"maxBodyBytes" json:"maxBodyBytes"`
+	Policies       []ComplexityPolicyConfig `mapstructure:"complexityPolicies" json:"complexityPolicies"`
+	APIKeys        map[string]APIKey        `mapstructure:"apiKeys" json:"apiKeys"`
+	Stats          map[string]StatsEntry    `mapstructure:"stats" json:"stats"`
+
+	// Path is the file the configuration was loaded from
+	Path string `mapstructure:"-" json:"-"`
 }
 
 // LoadConfig loads the configuration from files, environment variables, and flags
 func LoadConfig() (*ServerConfig, error) {
 	config := &ServerConfig{
-		APIKeys: make(map[string][]string),
+		APIKeys: make(map[string]APIKey),
 		Stats:   make(map[string]StatsEntry),
 	}
 
 	// Initialize stats for each API key
 	for key := range config.APIKeys {
 		if _, exists := config.Stats[key]; !exists {
-			config.Stats[key] = StatsEntry{
-				IPThrottleCount: make(map[string]int64),
-			}
+			config.Stats[key] = StatsEntry{}
 		}
 	}
 
-	// Create config file if it doesn't exist
-	if err := ensureConfig("./verity.yaml"); err != nil {
-		return nil, fmt.Errorf("error ensuring config: %w", err)
-	}
-
 	// Setup command line flags
 	configPath := flag.String("config", "./verity.yaml", "path to config file")
 	addr := flag.String("addr", "", "server address")
@@ -60,45 +92,43 @@ func LoadConfig() (*ServerConfig, error) {
 	algorithm := flag.String("algorithm", "", "hash algorithm (SHA256 or SHA512)")
 	complexity := flag.Int64("complexity", 0, "challenge complexity")
 	expireTime := flag.String("expire-time", "", "challenge expire time")
-
-	// Add command for generating API keys
-	addCmd := flag.NewFlagSet("add", flag.ExitOnError)
+	replayStore := flag.String("replay-store", "", "replay protection store (memory, file or redis)")
+	replayFile := flag.String("replay-file", "", "replay log path for the file replay store")
+	redisAddr := flag.String("redis-addr", "", "server address for the redis replay store")
+	maxIPs := flag.Int("max-tracked-ips", 0, "maximum number of client IPs tracked per map")
+	ipStatsTTL := flag.String("ip-stats-ttl", "", "how long per-IP challenge counts are kept after the last request")
+	challengeRate := flag.String("challenge-rate", "", "per-IP challenge rate limit, such as 100/10m")
+	challengeBurst := flag.Int("challenge-burst", 0, "per-IP challenge burst size")
+	verifyRate := flag.String("verify-rate", "", "per-IP verification rate limit, such as 100/10m")
+	verifyBurst := flag.Int("verify-burst", 0, "per-IP verification burst size")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated CIDR ranges of proxies whose forwarding headers are trusted")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "accept PROXY protocol headers from trusted proxies")
+	ipv4Prefix := flag.Int("ipv4-prefix", 0, "prefix length grouping IPv4 clients, such as 24")
+	ipv6Prefix := flag.Int("ipv6-prefix", 0, "prefix length grouping IPv6 clients, such as 64 or 56")
+	allowListFile := flag.String("allow-list-file", "", "file of CIDR ranges exempt from rate limits")
+	denyListFile := flag.String("deny-list-file", "", "file of CIDR ranges to block")
+	maxBodyBytes := flag.Int64("max-body-bytes", 0, "maximum size of request bodies, in bytes")
+	apiKeySources := flag.String("api-key-sources", "", "comma-separated places to read API keys from, in order (bearer, header, form, query)")
 
 	// Custom usage
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
 		fmt.Println("Commands:")
 		fmt.Println("  add <domain1> [domain2...]  Generate new API key for specified domains")
+		fmt.Println("  keys <command> [args...]    Manage API keys, see 'keys help'")
 		fmt.Println("\nFlags:")
 		flag.PrintDefaults()
 	}
 
-	// Parse flags
-	if len(os.Args) > 1 && os.Args[1] == "add" {
-		addCmd.Parse(os.Args[2:])
-		if addCmd.NArg() < 1 {
-			fmt.Println("Error: at least one domain is required")
-			addCmd.Usage()
-			os.Exit(1)
-		}
-		return handleAddCommand(addCmd.Args(), configPath)
-	}
-
 	flag.Parse()
 
-	// Initialize viper
-	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
-	v.SetConfigFile(*configPath)
-	v.SetEnvPrefix(EnvPrefix)
-	v.AutomaticEnv()
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	// Create config file if it doesn't exist
+	if err := ensureConfig(*configPath); err != nil {
+		return nil, fmt.Errorf("error ensuring config: %w", err)
+	}
 
-	// Set defaults
-	v.SetDefault("addr", DefaultAddr)
-	v.SetDefault("port", DefaultPort)
-	v.SetDefault("complexity", DefaultComplexity)
-	v.SetDefault("expireTime", DefaultExpireTime)
-	v.SetDefault("algorithm", "SHA-256")
+	// Initialize viper
+	v := newServerViper(*configPath)
 
 	// Read config file
 	if err := v.ReadInConfig(); err != nil {
@@ -121,9 +151,60 @@ func LoadConfig() (*ServerConfig, error) {
 	if *expireTime != "" {
 		v.Set("expireTime", *expireTime)
 	}
+	if *replayStore != "" {
+		v.Set("replayStore", *replayStore)
+	}
+	if *replayFile != "" {
+		v.Set("replayFile", *replayFile)
+	}
+	if *redisAddr != "" {
+		v.Set("redisAddr", *redisAddr)
+	}
+	if *maxIPs != 0 {
+		v.Set("maxTrackedIPs", *maxIPs)
+	}
+	if *ipStatsTTL != "" {
+		v.Set("ipStatsTTL", *ipStatsTTL)
+	}
+	if *challengeRate != "" {
+		v.Set("challengeRateLimit", *challengeRate)
+	}
+	if *challengeBurst != 0 {
+		v.Set("challengeBurst", *challengeBurst)
+	}
+	if *verifyRate != "" {
+		v.Set("verifyRateLimit", *verifyRate)
+	}
+	if *verifyBurst != 0 {
+		v.Set("verifyBurst", *verifyBurst)
+	}
+	if *trustedProxies != "" {
+		v.Set("trustedProxies", strings.Split(*trustedProxies, ","))
+	}
+	if *proxyProtocol {
+		v.Set("proxyProtocol", true)
+	}
+	if *ipv4Prefix != 0 {
+		v.Set("ipv4Prefix", *ipv4Prefix)
+	}
+	if *ipv6Prefix != 0 {
+		v.Set("ipv6Prefix", *ipv6Prefix)
+	}
+	if *allowListFile != "" {
+		v.Set("allowListFile", *allowListFile)
+	}
+	if *denyListFile != "" {
+		v.Set("denyListFile", *denyListFile)
+	}
+	if *maxBodyBytes != 0 {
+		v.Set("maxBodyBytes", *maxBodyBytes)
+	}
+	if *apiKeySources != "" {
+		v.Set("apiKeySources", strings.Split(*apiKeySources, ","))
+	}
 
 	// Unmarshal config
-	if err := v.Unmarshal(config); err != nil {
+	if err := v.Unmarshal(config, decodeHook()); err != nil {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
@@ -131,10 +212,157 @@ func LoadConfig() (*ServerConfig, error) {
 	if err := validateConfig(config); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
+	config.Path = *configPath
+
+	// Rewrite API keys from older versions in the current format
+	if err := migrateAPIKeys(v, config); err != nil {
+		return nil, fmt.Errorf("error migrating API keys: %w", err)
+	}
+
+	return config, nil
+}
+
+// newConfigViper returns a viper instance for the config file at path, with
+// the default of every setting
+func newConfigViper(path string) *viper.Viper {
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	v.SetConfigFile(path)
+
+	// Set defaults
+	v.SetDefault("addr", DefaultAddr)
+	v.SetDefault("port", DefaultPort)
+	v.SetDefault("complexity", DefaultComplexity)
+	v.SetDefault("expireTime", DefaultExpireTime)
+	v.SetDefault("algorithm", "SHA-256")
+	v.SetDefault("replayStore", DefaultReplay)
+	v.SetDefault("replayFile", DefaultReplayFile)
+	v.SetDefault("redisAddr", DefaultRedisAddr)
+	v.SetDefault("redisPassword", "")
+	v.SetDefault("redisDB", 0)
+	v.SetDefault("redisPrefix", DefaultRedisKey)
+	v.SetDefault("maxTrackedIPs", DefaultMaxIPs)
+	v.SetDefault("ipStatsTTL", DefaultIPStatsTTL)
+	v.SetDefault("challengeRateLimit", DefaultRateLimit)
+	v.SetDefault("challengeBurst", DefaultBurst)
+	v.SetDefault("verifyRateLimit", DefaultRateLimit)
+	v.SetDefault("verifyBurst", DefaultBurst)
+	v.SetDefault("trustedProxies", DefaultTrustedProxies)
+	v.SetDefault("proxyProtocol", false)
+	v.SetDefault("ipv4Prefix", DefaultIPv4Prefix)
+	v.SetDefault("ipv6Prefix", DefaultIPv6Prefix)
+	v.SetDefault("allowList", []string{})
+	v.SetDefault("allowListFile", "")
+	v.SetDefault("denyList", []string{})
+	v.SetDefault("denyListFile", "")
+	v.SetDefault("apiKeySources", DefaultAPIKeySources)
+	v.SetDefault("legacyV1Responses", true)
+	v.SetDefault("maxBodyBytes", DefaultMaxBody)
+	v.SetDefault("complexityPolicies", DefaultComplexityPolicies())
+
+	return v
+}
+
+// newServerViper returns a viper for the config file of a server, where
+// environment variables override the file
+func newServerViper(path string) *viper.Viper {
+	v := newConfigViper(path)
+	v.SetEnvPrefix(EnvPrefix)
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	return v
+}
+
+// readServerConfig reads the config file with environment overrides, as a
+// running server sees it, to pick up settings that apply without a restart
+func readServerConfig(path string) (*ServerConfig, error) {
+	v := newServerViper(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	config := &ServerConfig{}
+	if err := v.Unmarshal(config, decodeHook()); err != nil {
+		return nil, fmt.Errorf("error unmarshaling config: %w", err)
+	}
+	return config, nil
+}
 
+// ReadConfigFile reads the config file at path, without applying
+// environment variables or flags. API keys from older versions are
+// converted to the current format, which is saved if the config is.
+func ReadConfigFile(path string) (*ServerConfig, error) {
+	v := newConfigViper(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+
+	config := &ServerConfig{}
+	if err := v.Unmarshal(config, decodeHook()); err != nil {
+		return nil, fmt.Errorf("error unmarshaling config: %w", err)
+	}
+	if config.APIKeys == nil {
+		config.APIKeys = make(map[string]APIKey)
+	}
+	if config.Stats == nil {
+		config.Stats = make(map[string]StatsEntry)
+	}
+	if _, err := hashLegacyKeys(config, time.Now().UTC().Truncate(time.Second)); err != nil {
+		return nil, err
+	}
+	config.Path = path
 	return config, nil
 }
 
+// UpdateConfig applies fn to the config file at path while holding its lock,
+// so concurrent edits, such as from the keys command and a running server,
+// don't overwrite each other. The file is only written if fn succeeds.
+func UpdateConfig(path string, fn func(config *ServerConfig) error) error {
+	unlock, err := lockConfig(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	config, err := ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(config); err != nil {
+		return err
+	}
+	return SaveConfig(path, config)
+}
+
+// migrateAPIKeys rewrites API keys saved by older versions, which were
+// stored in plaintext or without a creation time, in the current format
+func migrateAPIKeys(v *viper.Viper, config *ServerConfig) error {
+	raw, _ := v.Get("apiKeys").(map[string]interface{})
+	migrate := 0
+	for apiKey, entry := range raw {
+		if key, exists := config.APIKeys[apiKey]; exists && (isLegacyAPIKey(apiKey, entry) || key.CreatedAt.IsZero()) {
+			migrate++
+		}
+	}
+	if migrate == 0 {
+		return nil
+	}
+
+	// ReadConfigFile converts the keys, so saving the file is enough
+	var migrated *ServerConfig
+	err := UpdateConfig(config.Path, func(saved *ServerConfig) error {
+		migrated = saved
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keep the running configuration in line with the file
+	config.APIKeys = migrated.APIKeys
+	config.Stats = migrated.Stats
+	log.Printf("Migrated %d API keys to the current format.", migrate)
+	return nil
+}
+
 // ensureConfig creates a default config file if it doesn't exist
 func ensureConfig(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -146,14 +374,33 @@ func ensureConfig(path string) error {
 
 		// Create default config
 		config := &ServerConfig{
-			Addr:       DefaultAddr,
-			Port:       DefaultPort,
-			HMACKey:    "",
-			Algorithm:  "SHA-256",
-			Complexity: DefaultComplexity,
-			ExpireTime: DefaultExpireTime,
-			APIKeys:    make(map[string][]string),
-			Stats:      make(map[string]StatsEntry),
+			Addr:           DefaultAddr,
+			Port:           DefaultPort,
+			HMACKey:        "",
+			Algorithm:      "SHA-256",
+			Complexity:     DefaultComplexity,
+			ExpireTime:     DefaultExpireTime,
+			ReplayStore:    DefaultReplay,
+			ReplayFile:     DefaultReplayFile,
+			RedisAddr:      DefaultRedisAddr,
+			RedisPrefix:    DefaultRedisKey,
+			MaxIPs:         DefaultMaxIPs,
+			IPStatsTTL:     DefaultIPStatsTTL,
+			ChallengeRate:  DefaultRateLimit,
+			ChallengeBurst: DefaultBurst,
+			VerifyRate:     DefaultRateLimit,
+			VerifyBurst:    DefaultBurst,
+			TrustedProxies: DefaultTrustedProxies,
+			IPv4Prefix:     DefaultIPv4Prefix,
+			IPv6Prefix:     DefaultIPv6Prefix,
+			AllowList:      []string{},
+			DenyList:       []string{},
+			APIKeySources:  DefaultAPIKeySources,
+			LegacyV1:       true,
+			MaxBodyBytes:   DefaultMaxBody,
+			Policies:       DefaultComplexityPolicies(),
+			APIKeys:        make(map[string]APIKey),
+			Stats:          make(map[string]StatsEntry),
 		}
 
 		config.HMACKey, err = GenerateHMACKey()
@@ -181,10 +428,63 @@ func SaveConfig(path string, config *ServerConfig) error {
 	v.Set("algorithm", config.Algorithm)
 	v.Set("complexity", config.Complexity)
 	v.Set("expireTime", config.ExpireTime)
+	v.Set("replayStore", config.ReplayStore)
+	v.Set("replayFile", config.ReplayFile)
+	v.Set("redisAddr", config.RedisAddr)
+	v.Set("redisPassword", config.RedisPass)
+	v.Set("redisDB", config.RedisDB)
+	v.Set("redisPrefix", config.RedisPrefix)
+	v.Set("maxTrackedIPs", config.MaxIPs)
+	v.Set("ipStatsTTL", config.IPStatsTTL)
+	v.Set("challengeRateLimit", config.ChallengeRate)
+	v.Set("challengeBurst", config.ChallengeBurst)
+	v.Set("verifyRateLimit", config.VerifyRate)
+	v.Set("verifyBurst", config.VerifyBurst)
+	v.Set("trustedProxies", config.TrustedProxies)
+	v.Set("proxyProtocol", config.ProxyProtocol)
+	v.Set("ipv4Prefix", config.IPv4Prefix)
+	v.Set("ipv6Prefix", config.IPv6Prefix)
+	v.Set("allowList", config.AllowList)
+	v.Set("allowListFile", config.AllowListFile)
+	v.Set("denyList", config.DenyList)
+	v.Set("denyListFile", config.DenyListFile)
+	v.Set("apiKeySources", config.APIKeySources)
+	v.Set("legacyV1Responses", config.LegacyV1)
+	v.Set("maxBodyBytes", config.MaxBodyBytes)
+	v.Set("complexityPolicies", config.Policies)
 	v.Set("apiKeys", config.APIKeys)
 	v.Set("stats", config.Stats)
 
-	return v.WriteConfig()
+	return writeConfigAtomic(v, path)
+}
+
+// writeConfigAtomic writes the config to a temporary file next to path and
+// renames it over path, so readers never see a partly written file
+func writeConfigAtomic(v *viper.Viper, path string) error {
+	// Keep the extension, which tells viper the format
+	ext := filepath.Ext(path)
+	tmpPath := filepath.Join(filepath.Dir(path), "."+strings.TrimSuffix(filepath.Base(path), ext)+".tmp"+ext)
+	if err := v.WriteConfigAs(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	tmp, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error syncing config: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error replacing config: %w", err)
+	}
+	return nil
 }
 
 // validateConfig validates the configuration values
@@ -201,45 +501,151 @@ func validateConfig(config *ServerConfig) error {
 		return fmt.Errorf("complexity must be greater than 0")
 	}
 
+	if config.MaxIPs < 0 {
+		return fmt.Errorf("maxTrackedIPs must not be negative")
+	}
+
+	if _, err := time.ParseDuration(config.IPStatsTTL); err != nil {
+		return fmt.Errorf("invalid ipStatsTTL: %w", err)
+	}
+
+	if _, err := ParseRate(config.ChallengeRate); err != nil {
+		return fmt.Errorf("invalid challengeRateLimit: %w", err)
+	}
+	if _, err := ParseRate(config.VerifyRate); err != nil {
+		return fmt.Errorf("invalid verifyRateLimit: %w", err)
+	}
+	if config.ChallengeBurst < 1 || config.VerifyBurst < 1 {
+		return fmt.Errorf("challengeBurst and verifyBurst must be at least 1")
+	}
+	if config.MaxBodyBytes < 1 {
+		return fmt.Errorf("maxBodyBytes must be at least 1")
+	}
+
+	if _, err := ParseTrustedProxies(config.TrustedProxies); err != nil {
+		return err
+	}
+
+	if config.IPv4Prefix < 1 || config.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4Prefix must be between 1 and 32")
+	}
+	if config.IPv6Prefix < 1 || config.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6Prefix must be between 1 and 128")
+	}
+
+	if _, err := NewAccessRules(config.AllowList, config.AllowListFile, config.DenyList, config.DenyListFile); err != nil {
+		return err
+	}
+
+	if err := validateKeySources(config.APIKeySources); err != nil {
+		return err
+	}
+
+	if err := validatePolicies(config.Policies); err != nil {
+		return fmt.Errorf("invalid complexityPolicies: %w", err)
+	}
+
+	for apiKey, key := range config.APIKeys {
+		if key.Hash == "" && !strings.HasPrefix(apiKey, apiKeyPrefix) {
+			return fmt.Errorf("API key %s has no hash; create keys with the add command", apiKey)
+		}
+		if key.RateLimit != "" {
+			if _, err := ParseRate(key.RateLimit); err != nil {
+				return fmt.Errorf("invalid rateLimit for API key %s: %w", apiKey, err)
+			}
+		}
+		if key.DailyQuota < 0 || key.MonthlyQuota < 0 {
+			return fmt.Errorf("quotas for API key %s must not be negative", apiKey)
+		}
+		if _, err := key.accessRules(); err != nil {
+			return fmt.Errorf("API key %s: %w", apiKey, err)
+		}
+		if key.Algorithm != "" && key.Algorithm != "SHA-256" && key.Algorithm != "SHA-512" {
+			return fmt.Errorf("invalid algorithm for API key %s: must be SHA-256 or SHA-512", apiKey)
+		}
+		if key.ExpireTime != "" {
+			if _, err := time.ParseDuration(key.ExpireTime); err != nil {
+				return fmt.Errorf("invalid expireTime for API key %s: %w", apiKey, err)
+			}
+		}
+		if key.MinComplexity < 0 || key.MaxComplexity < 0 ||
+			(key.MaxComplexity > 0 && key.MinComplexity > key.MaxComplexity) {
+			return fmt.Errorf("complexity range for API key %s must satisfy 0 <= minComplexity <= maxComplexity", apiKey)
+		}
+		if key.SaltLength < 0 {
+			return fmt.Errorf("saltLength for API key %s must not be negative", apiKey)
+		}
+	}
+
+	switch config.ReplayStore {
+	case "", ReplayStoreMemory:
+	case ReplayStoreFile:
+		if config.ReplayFile == "" {
+			return fmt.Errorf("replayFile is required for the file replay store")
+		}
+	case ReplayStoreRedis:
+		if config.RedisAddr == "" {
+			return fmt.Errorf("redisAddr is required for the redis replay store")
+		}
+	default:
+		return fmt.Errorf("invalid replayStore: %s", config.ReplayStore)
+	}
+
 	return nil
 }
 
-// handleAddCommand handles the 'add' command for generating API keys
-func handleAddCommand(domains []string, configPath *string) (*ServerConfig, error) {
-	// Load existing config
-	config := &ServerConfig{}
-	v := viper.New()
-	v.SetConfigFile(*configPath)
-
-	if err := v.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("error reading config: %w", err)
+// runAddCommand handles the 'add' command for generating API keys
+func runAddCommand(args []string) error {
+	addCmd := flag.NewFlagSet("add", flag.ContinueOnError)
+	configPath := addCmd.String("config", "./verity.yaml", "path to config file")
+	addCmd.Usage = func() {
+		fmt.Fprintf(addCmd.Output(), "Usage of %s add:\n  %s add [-config path] <domain1> [domain2...]\n", os.Args[0], os.Args[0])
+		addCmd.PrintDefaults()
+	}
+	if err := addCmd.Parse(args); err != nil {
+		return err
 	}
+	if addCmd.NArg() < 1 {
+		addCmd.Usage()
+		return fmt.Errorf("at least one domain is required")
+	}
+	domains := addCmd.Args()
 
-	if err := v.Unmarshal(config); err != nil {
-		return nil, fmt.Errorf("error unmarshaling config: %w", err)
+	// Create config file if it doesn't exist
+	if err := ensureConfig(*configPath); err != nil {
+		return fmt.Errorf("error ensuring config: %w", err)
 	}
 
 	// Generate new API key
-	apiKey, err := GenerateAPIKey()
+	id, err := GenerateKeyID()
 	if err != nil {
-		return nil, fmt.Errorf("Error while adding an API key: %w", err)
+		return fmt.Errorf("Error while adding an API key: %w", err)
 	}
-
-	// Initialise APIKey map if nil
-	if config.APIKeys == nil {
-		config.APIKeys = make(map[string][]string)
+	key := NewAPIKey(domains)
+	apiKey, err := key.issue(id)
+	if err != nil {
+		return fmt.Errorf("Error while adding an API key: %w", err)
 	}
-	// Add to config
-	config.APIKeys[apiKey] = domains
-
-	// Save updated config
-	if err := SaveConfig(*configPath, config); err != nil {
-		return nil, fmt.Errorf("error saving config: %w", err)
+	secretKey, err := key.issueSecretKey(id)
+	if err != nil {
+		return fmt.Errorf("Error while adding an API key: %w", err)
 	}
 
-	// Print the generated API key
-	fmt.Printf("Generated API key:\n%s\nAllowed domains: %s\nPlease restart Verity for the changes to take effect.", apiKey, strings.Join(domains, ", "))
+	// Add to config
+	err = UpdateConfig(*configPath, func(config *ServerConfig) error {
+		if _, exists := config.APIKeys[id]; exists {
+			return fmt.Errorf("API key ID %s is already in use", id)
+		}
+		config.APIKeys[id] = key
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error saving config: %w", err)
+	}
 
-	os.Exit(0)
-	return config, nil
+	// Print the generated keys. Only their hashes are stored.
+	fmt.Printf("Generated site key, for requesting challenges from web pages:\n%s\n", apiKey)
+	fmt.Printf("Generated secret key, for verifying solutions from your backend:\n%s\n", secretKey)
+	fmt.Printf("These keys will not be shown again.\nKey ID: %s\nAllowed domains: %s\nPlease restart Verity for the changes to take effect.\n", id, strings.Join(domains, ", "))
+	return nil
 }
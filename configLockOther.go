@@ -0,0 +1,34 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// configLockTimeout bounds how long lockConfig waits for another process
+const configLockTimeout = 10 * time.Second
+
+// lockConfig takes an exclusive lock on the config file at path by creating
+// a lock file next to it, waiting while another process holds it. A lock
+// file left behind by a crash has to be removed by hand.
+func lockConfig(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(configLockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("error creating config lock: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("config is locked, remove %s if no other Verity process is running", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// errTestUpdate is returned by a failing config update
+var errTestUpdate = errors.New("update failed")
+
+func TestUpdateConfigConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	if err := ensureConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the lock, concurrent read-modify-write cycles lose updates
+	const updates = 20
+	var wg sync.WaitGroup
+	for range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := UpdateConfig(path, func(config *ServerConfig) error {
+				stats := config.Stats["counter"]
+				stats.TotalChallenges++
+				config.Stats["counter"] = stats
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	config, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Stats["counter"].TotalChallenges; got != updates {
+		t.Errorf("counter = %d after %d updates", got, updates)
+	}
+}
+
+func TestUpdateConfigError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	if err := ensureConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UpdateConfig(path, func(config *ServerConfig) error {
+		config.HMACKey = "changed"
+		return errTestUpdate
+	})
+	if err != errTestUpdate {
+		t.Fatalf("UpdateConfig error = %v, want %v", err, errTestUpdate)
+	}
+	after, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.HMACKey != before.HMACKey {
+		t.Error("config was written although the update failed")
+	}
+}
+
+// legacyTestConfig is a config file written by an older version, with a
+// plaintext key holding a list of origins, and a key without creation time
+const legacyTestConfig = `hmacKey: test-hmac-key
+apiKeys:
+  ` + legacyTestKey + `:
+    - https://example.com
+  0123abcd:
+    salt: "00"
+    hash: "11"
+    origins:
+      - https://example.org
+stats:
+  ` + legacyTestKey + `:
+    totalChallenges: 7
+    solvedChallenges: 5
+`
+
+// readForMigration reads a config file the way LoadConfig does, before its
+// API keys are migrated
+func readForMigration(t *testing.T, path string) (*viper.Viper, *ServerConfig) {
+	t.Helper()
+	v := newConfigViper(path)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	config := &ServerConfig{}
+	if err := v.Unmarshal(config, decodeHook()); err != nil {
+		t.Fatal(err)
+	}
+	config.Path = path
+	return v, config
+}
+
+func TestMigrateAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	if err := os.WriteFile(path, []byte(legacyTestConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, config := readForMigration(t, path)
+	if err := migrateAPIKeys(v, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// The running configuration and the file both hold the migrated keys
+	saved, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := legacyKeyID(legacyTestKey)
+	for name, c := range map[string]*ServerConfig{"running": config, "saved": saved} {
+		key, ok := c.APIKeys[id]
+		if !ok || !matchesSiteKey(key, legacyTestKey) || !key.Enabled || key.CreatedAt.IsZero() {
+			t.Errorf("%s: legacy key = %+v, %v", name, key, ok)
+		}
+		if stats := c.Stats[id]; stats.TotalChallenges != 7 || stats.SolvedChallenges != 5 {
+			t.Errorf("%s: stats of the legacy key = %+v", name, stats)
+		}
+		if key := c.APIKeys["0123abcd"]; key.Hash != "11" || !key.Enabled || key.CreatedAt.IsZero() {
+			t.Errorf("%s: key without creation time = %+v", name, key)
+		}
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), legacyTestKey) {
+		t.Error("config file still contains the plaintext key")
+	}
+
+	// A second migration finds nothing to do and leaves the file alone
+	v, config = readForMigration(t, path)
+	if err := migrateAPIKeys(v, config); err != nil {
+		t.Fatal(err)
+	}
+	again, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(raw) {
+		t.Errorf("second migration rewrote the config file:\n%s", again)
+	}
+	if key := config.APIKeys[id]; key.Hash != saved.APIKeys[id].Hash || key.Salt != saved.APIKeys[id].Salt {
+		t.Error("second migration changed the hash of the key")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ReplayStoreFile keeps solved challenges in an append-only log file
+	ReplayStoreFile = "file"
+)
+
+// FileChallengeManager is a replay store backed by an append-only log, so
+// solved challenges are remembered across restarts. Each line holds the
+// expiry time and the quoted challenge. Expired lines are dropped when the
+// log is compacted.
+type FileChallengeManager struct {
+	path             string
+	file             *os.File
+	solvedChallenges map[string]int64
+	logEntries       int
+	mu               sync.Mutex
+	expireDuration   time.Duration
+	done             chan struct{}
+	closeOnce        sync.Once
+}
+
+// NewFileChallengeManager opens or creates the replay log at path and loads
+// all challenges that have not expired yet
+func NewFileChallengeManager(path string, expireDuration string) (*FileChallengeManager, error) {
+	duration, err := time.ParseDuration(expireDuration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expire duration: %w", err)
+	}
+	cm := &FileChallengeManager{
+		path:             path,
+		solvedChallenges: make(map[string]int64),
+		expireDuration:   duration,
+		done:             make(chan struct{}),
+	}
+	if err := cm.load(); err != nil {
+		return nil, err
+	}
+	// Start from a compacted log, so expired entries from before the
+	// restart don't linger.
+	if err := cm.compact(); err != nil {
+		return nil, err
+	}
+	go cm.cleanupLoop()
+	return cm, nil
+}
+
+func (cm *FileChallengeManager) AddChallenge(challenge string, expireAt int64) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.add(challenge, expireAt)
+}
+
+func (cm *FileChallengeManager) Exists(challenge string) (bool, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	_, ok := cm.solvedChallenges[challenge]
+	return ok, nil
+}
+
+func (cm *FileChallengeManager) TryConsume(challenge string, expireAt int64) (bool, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.solvedChallenges[challenge]; ok {
+		return false, nil
+	}
+	if err := cm.add(challenge, expireAt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Close stops the cleanup and closes the log. Calling it again does
+// nothing.
+func (cm *FileChallengeManager) Close() error {
+	var err error
+	cm.closeOnce.Do(func() {
+		close(cm.done)
+		cm.mu.Lock()
+		defer cm.mu.Unlock()
+		err = cm.file.Close()
+	})
+	return err
+}
+
+// add appends a challenge to the log before recording it in memory. The
+// entry is synced to disk first, so a crash can't forget a solved challenge
+// and allow it to be replayed after a restart. The caller must hold cm.mu.
+func (cm *FileChallengeManager) add(challenge string, expireAt int64) error {
+	if _, err := cm.file.WriteString(formatReplayEntry(challenge, expireAt)); err != nil {
+		return fmt.Errorf("error writing replay log: %w", err)
+	}
+	if err := cm.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing replay log: %w", err)
+	}
+	cm.solvedChallenges[challenge] = expireAt
+	cm.logEntries++
+	return nil
+}
+
+// load reads the replay log, skipping expired and malformed lines. A
+// malformed line is usually a partial write from a crash.
+func (cm *FileChallengeManager) load() error {
+	file, err := os.Open(cm.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening replay log: %w", err)
+	}
+	defer file.Close()
+
+	now := time.Now().Unix()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		challenge, expireAt, err := parseReplayEntry(scanner.Text())
+		if err != nil {
+			log.Printf("Skipping malformed replay log entry: %v", err)
+			continue
+		}
+		if expireAt >= now {
+			cm.solvedChallenges[challenge] = expireAt
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading replay log: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the log with only the live challenges and reopens it for
+// appending. The caller must hold cm.mu, or be the constructor.
+func (cm *FileChallengeManager) compact() error {
+	tmpPath := cm.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating replay log: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for challenge, expireAt := range cm.solvedChallenges {
+		if _, err := writer.WriteString(formatReplayEntry(challenge, expireAt)); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error writing replay log: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing replay log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing replay log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing replay log: %w", err)
+	}
+	if err := os.Rename(tmpPath, cm.path); err != nil {
+		return fmt.Errorf("error replacing replay log: %w", err)
+	}
+
+	file, err := os.OpenFile(cm.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening replay log: %w", err)
+	}
+	if cm.file != nil {
+		cm.file.Close()
+	}
+	cm.file = file
+	cm.logEntries = len(cm.solvedChallenges)
+	return nil
+}
+
+func (cm *FileChallengeManager) cleanupLoop() {
+	ticker := time.NewTicker(cm.expireDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cm.cleanupExpired()
+		case <-cm.done:
+			return
+		}
+	}
+}
+
+func (cm *FileChallengeManager) cleanupExpired() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	for challenge, val := range cm.solvedChallenges {
+		if val < now {
+			delete(cm.solvedChallenges, challenge)
+		}
+	}
+
+	// Compact once more than half of the log is made of expired entries
+	if cm.logEntries > 2*len(cm.solvedChallenges) {
+		if err := cm.compact(); err != nil {
+			log.Printf("Error compacting replay log: %v", err)
+		}
+	}
+}
+
+// formatReplayEntry formats a replay log line. The challenge is quoted, as
+// it comes from the client and may contain anything.
+func formatReplayEntry(challenge string, expireAt int64) string {
+	return strconv.FormatInt(expireAt, 10) + " " + strconv.Quote(challenge) + "\n"
+}
+
+// parseReplayEntry parses a line written by formatReplayEntry
+func parseReplayEntry(line string) (string, int64, error) {
+	expires, quoted, found := strings.Cut(line, " ")
+	if !found {
+		return "", 0, fmt.Errorf("missing separator")
+	}
+	expireAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid expiry: %w", err)
+	}
+	challenge, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid challenge: %w", err)
+	}
+	return challenge, expireAt, nil
+}
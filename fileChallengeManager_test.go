@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileChallengeManagerSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.replay")
+	expireAt := time.Now().Add(time.Hour).Unix()
+
+	cm, err := NewFileChallengeManager(path, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumed, err := cm.TryConsume("solved", expireAt); err != nil || !consumed {
+		t.Fatalf("TryConsume = %v, %v; want true", consumed, err)
+	}
+	if err := cm.AddChallenge("added", expireAt); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash: the log must already be on disk before Close
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"solved"`) || !strings.Contains(string(data), `"added"`) {
+		t.Fatalf("replay log missing entries:\n%s", data)
+	}
+	if err := cm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err = NewFileChallengeManager(path, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	for _, challenge := range []string{"solved", "added"} {
+		if exists, err := cm.Exists(challenge); err != nil || !exists {
+			t.Errorf("Exists(%q) after restart = %v, %v; want true", challenge, exists, err)
+		}
+	}
+	if consumed, _ := cm.TryConsume("solved", expireAt); consumed {
+		t.Error("challenge solved before the restart was consumed again")
+	}
+}
+
+func TestFileChallengeManagerSkipsExpiredAndMalformedEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.replay")
+	past := time.Now().Add(-time.Hour).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+	entries := formatReplayEntry("old", past) + "garbage\n" + formatReplayEntry("live", future) + "123 \"trunc"
+	if err := os.WriteFile(path, []byte(entries), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := NewFileChallengeManager(path, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	if exists, _ := cm.Exists("old"); exists {
+		t.Error("expired challenge was loaded")
+	}
+	if exists, _ := cm.Exists("live"); !exists {
+		t.Error("live challenge was not loaded")
+	}
+
+	// Loading compacts the log down to the live entries
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), formatReplayEntry("live", future); got != want {
+		t.Errorf("compacted log = %q, want %q", got, want)
+	}
+}
+
+func TestChallengeManagerCloseTwice(t *testing.T) {
+	file, err := NewFileChallengeManager(filepath.Join(t.TempDir(), "verity.replay"), "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory, err := NewMemoryChallengeManager("1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cm := range []ChallengeManager{file, memory} {
+		if err := cm.Close(); err != nil {
+			t.Fatalf("%T: first Close: %v", cm, err)
+		}
+		if err := cm.Close(); err != nil {
+			t.Errorf("%T: second Close: %v", cm, err)
+		}
+	}
+}
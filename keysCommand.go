@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// keysUsage describes the keys subcommands
+const keysUsage = `Usage: %s keys [-config path] [-json] <command> [args...]
+
+Commands:
+  list                            List all API keys
+  show <id>                       Show the settings of a key
+  revoke <id>                     Delete a key and its statistics
+  rotate <id>                     Replace the site key, keeping its settings
+  rotate-secret <id>              Replace the secret key, or issue one for an older key
+  set-origins <id> <origin>...    Replace the allowed origins of a key
+  add-origin <id> <origin>...     Allow more origins for a key
+  remove-origin <id> <origin>...  Stop allowing origins for a key
+  rename <id> <label>             Change the label of a key
+
+Keys are given by their ID, or by the full API key.
+
+Flags:
+`
+
+// keyInfo is the JSON form of an API key printed by the keys command
+type keyInfo struct {
+	ID              string     `json:"id"`
+	Issued          string     `json:"apiKey,omitempty"`    // Only after rotating
+	IssuedSecretKey string     `json:"secretKey,omitempty"` // Only after rotating
+	Status          string     `json:"status"`
+	HasSecretKey    bool       `json:"hasSecretKey"`
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"` // Unset rather than zero
+	APIKey
+}
+
+// newKeyInfo returns the JSON form of an API key
+func newKeyInfo(id string, key APIKey) keyInfo {
+	info := keyInfo{ID: id, Status: keyStatus(key), HasSecretKey: key.hasSecretKey(), APIKey: key}
+	if !key.ExpiresAt.IsZero() {
+		info.ExpiresAt = &key.ExpiresAt
+	}
+	return info
+}
+
+// runKeysCommand handles the 'keys' command for managing API keys
+func runKeysCommand(args []string) error {
+	keysCmd := flag.NewFlagSet("keys", flag.ContinueOnError)
+	configPath := keysCmd.String("config", "./verity.yaml", "path to config file")
+	asJSON := keysCmd.Bool("json", false, "print JSON instead of text")
+	keysCmd.Usage = func() {
+		fmt.Fprintf(keysCmd.Output(), keysUsage, os.Args[0])
+		keysCmd.PrintDefaults()
+	}
+
+	args, err := parseInterspersed(keysCmd, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "help" {
+		keysCmd.Usage()
+		if len(args) == 0 {
+			return fmt.Errorf("missing keys command")
+		}
+		return nil
+	}
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "list":
+		if err := requireArgs(args, 0, 0, "list"); err != nil {
+			return err
+		}
+		config, err := ReadConfigFile(*configPath)
+		if err != nil {
+			return err
+		}
+		return printKeyList(config.APIKeys, *asJSON)
+
+	case "show":
+		if err := requireArgs(args, 1, 1, "show <id>"); err != nil {
+			return err
+		}
+		config, err := ReadConfigFile(*configPath)
+		if err != nil {
+			return err
+		}
+		id, key, err := lookupKey(config, args[0])
+		if err != nil {
+			return err
+		}
+		return printKey(id, key, *asJSON)
+
+	case "revoke":
+		if err := requireArgs(args, 1, 1, "revoke <id>"); err != nil {
+			return err
+		}
+		var id string
+		var revoked APIKey
+		err := UpdateConfig(*configPath, func(config *ServerConfig) error {
+			var err error
+			id, revoked, err = lookupKey(config, args[0])
+			if err != nil {
+				return err
+			}
+			delete(config.APIKeys, id)
+			delete(config.Stats, id)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			info := newKeyInfo(id, revoked)
+			info.Status = "revoked"
+			return printJSON(info)
+		}
+		fmt.Printf("Revoked API key %s.\n", id)
+
+	case "rotate", "rotate-secret":
+		if err := requireArgs(args, 1, 1, command+" <id>"); err != nil {
+			return err
+		}
+		// The key keeps its ID, so its statistics and limits carry over
+		var id, newKey string
+		var rotated APIKey
+		err := UpdateConfig(*configPath, func(config *ServerConfig) error {
+			var err error
+			id, rotated, err = lookupKey(config, args[0])
+			if err != nil {
+				return err
+			}
+			if command == "rotate" {
+				newKey, err = rotated.issue(id)
+			} else {
+				newKey, err = rotated.issueSecretKey(id)
+			}
+			if err != nil {
+				return fmt.Errorf("error generating API key: %w", err)
+			}
+			config.APIKeys[id] = rotated
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			info := newKeyInfo(id, rotated)
+			if command == "rotate" {
+				info.Issued = newKey
+			} else {
+				info.IssuedSecretKey = newKey
+			}
+			return printJSON(info)
+		}
+		kind := "site key"
+		if command == "rotate-secret" {
+			kind = "secret key"
+		}
+		fmt.Printf("New %s for API key %s:\n%s\nThis key will not be shown again.\n", kind, id, newKey)
+
+	case "set-origins", "add-origin", "remove-origin":
+		if err := requireArgs(args, 2, -1, command+" <id> <origin>..."); err != nil {
+			return err
+		}
+		origins := args[1:]
+		return editKey(*configPath, args[0], *asJSON, func(key *APIKey) {
+			switch command {
+			case "set-origins":
+				key.Origins = origins
+			case "add-origin":
+				for _, origin := range origins {
+					if !slices.Contains(key.Origins, origin) {
+						key.Origins = append(key.Origins, origin)
+					}
+				}
+			case "remove-origin":
+				key.Origins = slices.DeleteFunc(key.Origins, func(origin string) bool {
+					return slices.Contains(origins, origin)
+				})
+			}
+		})
+
+	case "rename":
+		if err := requireArgs(args, 2, 2, "rename <id> <label>"); err != nil {
+			return err
+		}
+		return editKey(*configPath, args[0], *asJSON, func(key *APIKey) {
+			key.Label = args[1]
+		})
+
+	default:
+		keysCmd.Usage()
+		return fmt.Errorf("unknown keys command: %s", command)
+	}
+
+	if !*asJSON {
+		fmt.Println("Please restart Verity for the changes to take effect.")
+	}
+	return nil
+}
+
+// editKey applies fn to a key in the config file and prints the result
+func editKey(path, apiKey string, asJSON bool, fn func(key *APIKey)) error {
+	var id string
+	var edited APIKey
+	err := UpdateConfig(path, func(config *ServerConfig) error {
+		var err error
+		id, edited, err = lookupKey(config, apiKey)
+		if err != nil {
+			return err
+		}
+		fn(&edited)
+		config.APIKeys[id] = edited
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := printKey(id, edited, asJSON); err != nil {
+		return err
+	}
+	if !asJSON {
+		fmt.Println("Please restart Verity for the changes to take effect.")
+	}
+	return nil
+}
+
+// lookupKey returns the ID and settings of an API key in config, given
+// either its ID or the full key
+func lookupKey(config *ServerConfig, apiKey string) (string, APIKey, error) {
+	id := apiKey
+	if parsed, _, ok := parseSecretKey(apiKey); ok {
+		id = parsed
+	} else if parsed, _, ok := parseAPIKey(apiKey); ok {
+		id = parsed
+	}
+	key, exists := config.APIKeys[id]
+	if !exists {
+		return "", APIKey{}, fmt.Errorf("unknown API key: %s", id)
+	}
+	return id, key, nil
+}
+
+// requireArgs checks the number of arguments of a keys command, max < 0
+// meaning no limit
+func requireArgs(args []string, min, max int, usage string) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("usage: %s keys %s", os.Args[0], usage)
+	}
+	return nil
+}
+
+// parseInterspersed parses flags appearing anywhere among args, and returns
+// the other arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// keyStatus describes whether a key can be used
+func keyStatus(key APIKey) string {
+	switch {
+	case !key.Enabled:
+		return "disabled"
+	case key.Expired(time.Now()):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// printKeyList prints all keys, sorted by creation time
+func printKeyList(keys map[string]APIKey, asJSON bool) error {
+	list := make([]keyInfo, 0, len(keys))
+	for id, key := range keys {
+		list = append(list, newKeyInfo(id, key))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	if asJSON {
+		return printJSON(list)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tSTATUS\tSECRET KEY\tCREATED\tEXPIRES\tORIGINS")
+	withoutSecretKey := 0
+	for _, info := range list {
+		secretKey := "issued"
+		if !info.HasSecretKey {
+			secretKey = "none"
+			withoutSecretKey++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, info.Label, info.Status, secretKey,
+			formatDate(info.CreatedAt), formatDate(info.APIKey.ExpiresAt), strings.Join(info.Origins, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if withoutSecretKey > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d keys have no secret key, so their public site key can verify. Issue one with '%s keys rotate-secret <id>'.\n",
+			withoutSecretKey, os.Args[0])
+	}
+	return nil
+}
+
+// printKey prints the settings of a key
+func printKey(id string, key APIKey, asJSON bool) error {
+	if asJSON {
+		return printJSON(newKeyInfo(id, key))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", id)
+	fmt.Fprintf(w, "Label:\t%s\n", key.Label)
+	fmt.Fprintf(w, "Owner:\t%s\n", key.Owner)
+	fmt.Fprintf(w, "Status:\t%s\n", keyStatus(key))
+	fmt.Fprintf(w, "Created:\t%s\n", formatDate(key.CreatedAt))
+	fmt.Fprintf(w, "Expires:\t%s\n", formatDate(key.ExpiresAt))
+	if key.hasSecretKey() {
+		fmt.Fprintf(w, "Secret key:\tissued\n")
+	} else {
+		fmt.Fprintf(w, "Secret key:\tnone, the site key can verify; issue one with rotate-secret\n")
+	}
+	fmt.Fprintf(w, "Origins:\t%s\n", strings.Join(key.Origins, ", "))
+	if key.RateLimit != "" {
+		fmt.Fprintf(w, "Rate limit:\t%s, burst %d\n", key.RateLimit, key.Burst)
+	} else {
+		fmt.Fprintf(w, "Rate limit:\tglobal\n")
+	}
+	fmt.Fprintf(w, "Daily quota:\t%s\n", formatLimit(key.DailyQuota))
+	fmt.Fprintf(w, "Monthly quota:\t%s\n", formatLimit(key.MonthlyQuota))
+	fmt.Fprintf(w, "Allow list:\t%s\n", formatList(key.AllowList))
+	fmt.Fprintf(w, "Allow list file:\t%s\n", orDash(key.AllowListFile))
+	fmt.Fprintf(w, "Deny list:\t%s\n", formatList(key.DenyList))
+	fmt.Fprintf(w, "Deny list file:\t%s\n", orDash(key.DenyListFile))
+	fmt.Fprintf(w, "Algorithm:\t%s\n", orGlobal(string(key.Algorithm)))
+	fmt.Fprintf(w, "Min complexity:\t%s\n", orGlobal(formatNumber(key.MinComplexity)))
+	fmt.Fprintf(w, "Max complexity:\t%s\n", orGlobal(formatNumber(key.MaxComplexity)))
+	fmt.Fprintf(w, "Expire time:\t%s\n", orGlobal(key.ExpireTime))
+	fmt.Fprintf(w, "Salt length:\t%s\n", orGlobal(formatNumber(int64(key.SaltLength))))
+	fmt.Fprintf(w, "Notes:\t%s\n", orDash(key.Notes))
+	return w.Flush()
+}
+
+// formatLimit formats a quota, where 0 means unlimited
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// formatNumber formats a key setting, with "" for unset ones
+func formatNumber(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// formatList formats a list of IPs or ranges, with "-" for an empty list
+func formatList(list []string) string {
+	return orDash(strings.Join(list, ", "))
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// orGlobal returns s, or "global" for settings taken from the global config
+func orGlobal(s string) string {
+	if s == "" {
+		return "global"
+	}
+	return s
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// formatDate formats a key date for display, with "-" for unset dates
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
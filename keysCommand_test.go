@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newKeysConfig creates a config file with one API key and returns its path
+// and the keys
+func newKeysConfig(t *testing.T) (string, testKeys) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	if err := ensureConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := GenerateKeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewAPIKey([]string{testOrigin})
+	keys := testKeys{ID: id}
+	if keys.SiteKey, err = key.issue(id); err != nil {
+		t.Fatal(err)
+	}
+	if keys.SecretKey, err = key.issueSecretKey(id); err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateConfig(path, func(config *ServerConfig) error {
+		config.APIKeys[id] = key
+		config.Stats[id] = StatsEntry{TotalChallenges: 5}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, keys
+}
+
+// runKeys runs the keys command and returns what it printed
+func runKeys(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		output <- string(out)
+	}()
+	err = runKeysCommand(args)
+	w.Close()
+	return <-output, err
+}
+
+// showsField reports whether the text output of show has a line with label
+// and value
+func showsField(out, label, value string) bool {
+	pattern := "(?m)^" + regexp.QuoteMeta(label+":") + " +" + regexp.QuoteMeta(value) + "$"
+	return regexp.MustCompile(pattern).MatchString(out)
+}
+
+// matchesSiteKey reports whether apiKey is the site key of key
+func matchesSiteKey(key APIKey, apiKey string) bool {
+	_, secret, ok := parseAPIKey(apiKey)
+	return ok && key.checkSecret(secret)
+}
+
+// matchesSecretKey reports whether apiKey is the secret key of key
+func matchesSecretKey(key APIKey, apiKey string) bool {
+	_, secret, ok := parseSecretKey(apiKey)
+	return ok && key.checkSecretKey(secret)
+}
+
+// readKey returns a key from the config file at path
+func readKey(t *testing.T, path, id string) (APIKey, bool) {
+	t.Helper()
+	config, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := config.APIKeys[id]
+	return key, ok
+}
+
+func TestKeysShow(t *testing.T) {
+	path, keys := newKeysConfig(t)
+	err := UpdateConfig(path, func(config *ServerConfig) error {
+		key := config.APIKeys[keys.ID]
+		key.Label = "Shop"
+		key.RateLimit, key.Burst = "10/1m", 20
+		key.DailyQuota, key.MonthlyQuota = 100, 2000
+		key.AllowList, key.AllowListFile = []string{"192.0.2.0/24"}, "/etc/verity/allow.txt"
+		key.DenyList, key.DenyListFile = []string{"198.51.100.7"}, "/etc/verity/deny.txt"
+		key.Algorithm = "SHA-512"
+		key.MinComplexity, key.MaxComplexity = 5000, 90000
+		key.ExpireTime = "2m"
+		key.SaltLength = 24
+		key.Notes = "Checkout form"
+		config.APIKeys[keys.ID] = key
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys can be given by ID, site key or secret key
+	for _, ref := range []string{keys.ID, keys.SiteKey, keys.SecretKey} {
+		out, err := runKeys(t, "-config", path, "show", ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range [][2]string{
+			{"ID", keys.ID}, {"Label", "Shop"}, {"Origins", testOrigin},
+			{"Rate limit", "10/1m, burst 20"}, {"Daily quota", "100"}, {"Monthly quota", "2000"},
+			{"Allow list", "192.0.2.0/24"}, {"Allow list file", "/etc/verity/allow.txt"},
+			{"Deny list", "198.51.100.7"}, {"Deny list file", "/etc/verity/deny.txt"},
+			{"Algorithm", "SHA-512"}, {"Min complexity", "5000"}, {"Max complexity", "90000"},
+			{"Expire time", "2m"}, {"Salt length", "24"}, {"Notes", "Checkout form"},
+		} {
+			if !showsField(out, want[0], want[1]) {
+				t.Errorf("show %s output lacks %s: %s\n%s", ref, want[0], want[1], out)
+			}
+		}
+	}
+
+	out, err := runKeys(t, "-config", path, "-json", "show", keys.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info keyInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != keys.ID || info.MaxComplexity != 90000 || info.DenyListFile != "/etc/verity/deny.txt" || !info.HasSecretKey {
+		t.Errorf("JSON output = %+v", info)
+	}
+	key, _ := readKey(t, path, keys.ID)
+	if strings.Contains(out, key.Hash) || strings.Contains(out, key.SecretKeyHash) {
+		t.Error("JSON output contains key hashes")
+	}
+}
+
+func TestKeysShowDefaults(t *testing.T) {
+	path, keys := newKeysConfig(t)
+	out, err := runKeys(t, "-config", path, "show", keys.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][2]string{
+		{"Rate limit", "global"}, {"Daily quota", "unlimited"}, {"Allow list", "-"},
+		{"Algorithm", "global"}, {"Max complexity", "global"}, {"Notes", "-"},
+	} {
+		if !showsField(out, want[0], want[1]) {
+			t.Errorf("show output lacks %s: %s\n%s", want[0], want[1], out)
+		}
+	}
+}
+
+func TestKeysEdit(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		check func(t *testing.T, key APIKey)
+	}{
+		{"rename", []string{"rename", "", "Blog"}, func(t *testing.T, key APIKey) {
+			if key.Label != "Blog" {
+				t.Errorf("label = %q, want Blog", key.Label)
+			}
+		}},
+		{"set-origins", []string{"set-origins", "", "https://a.example", "https://b.example"}, func(t *testing.T, key APIKey) {
+			if !slices.Equal(key.Origins, []string{"https://a.example", "https://b.example"}) {
+				t.Errorf("origins = %v", key.Origins)
+			}
+		}},
+		{"add-origin", []string{"add-origin", "", testOrigin, "https://b.example"}, func(t *testing.T, key APIKey) {
+			if !slices.Equal(key.Origins, []string{testOrigin, "https://b.example"}) {
+				t.Errorf("origins = %v", key.Origins)
+			}
+		}},
+		{"remove-origin", []string{"remove-origin", "", testOrigin}, func(t *testing.T, key APIKey) {
+			if len(key.Origins) != 0 {
+				t.Errorf("origins = %v, want none", key.Origins)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, keys := newKeysConfig(t)
+			tt.args[1] = keys.ID
+			if _, err := runKeys(t, append([]string{"-config", path}, tt.args...)...); err != nil {
+				t.Fatal(err)
+			}
+			key, _ := readKey(t, path, keys.ID)
+			tt.check(t, key)
+			if !matchesSiteKey(key, keys.SiteKey) {
+				t.Error("editing the key changed its site key")
+			}
+		})
+	}
+}
+
+func TestKeysRotate(t *testing.T) {
+	path, keys := newKeysConfig(t)
+
+	out, err := runKeys(t, "-config", path, "-json", "rotate", keys.SiteKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info keyInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := readKey(t, path, keys.ID)
+	if matchesSiteKey(key, keys.SiteKey) || !matchesSiteKey(key, info.Issued) {
+		t.Error("rotate did not replace the site key")
+	}
+	if !matchesSecretKey(key, keys.SecretKey) {
+		t.Error("rotate changed the secret key")
+	}
+
+	out, err = runKeys(t, "-config", path, "-json", "rotate-secret", keys.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = keyInfo{}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatal(err)
+	}
+	key, _ = readKey(t, path, keys.ID)
+	if matchesSecretKey(key, keys.SecretKey) || !matchesSecretKey(key, info.IssuedSecretKey) {
+		t.Error("rotate-secret did not replace the secret key")
+	}
+}
+
+func TestKeysRevoke(t *testing.T) {
+	path, keys := newKeysConfig(t)
+	if _, err := runKeys(t, "-config", path, "revoke", keys.SecretKey); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.APIKeys[keys.ID]; ok {
+		t.Error("revoked key is still configured")
+	}
+	if _, ok := config.Stats[keys.ID]; ok {
+		t.Error("statistics of the revoked key were kept")
+	}
+}
+
+func TestKeysList(t *testing.T) {
+	path, keys := newKeysConfig(t)
+	out, err := runKeys(t, "-config", path, "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, keys.ID) || !strings.Contains(out, testOrigin) {
+		t.Errorf("list output lacks the key:\n%s", out)
+	}
+	if !regexp.MustCompile(keys.ID + ` .* issued `).MatchString(out) {
+		t.Errorf("list output does not show the secret key as issued:\n%s", out)
+	}
+
+	out, err = runKeys(t, "-config", path, "-json", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []keyInfo
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != keys.ID || list[0].Status != "active" {
+		t.Errorf("JSON list = %+v", list)
+	}
+}
+
+func TestKeysErrors(t *testing.T) {
+	path, keys := newKeysConfig(t)
+	for _, args := range [][]string{
+		{},
+		{"frobnicate"},
+		{"show"},
+		{"show", keys.ID, "extra"},
+		{"show", "unknown"},
+		{"rename", keys.ID},
+		{"add-origin", keys.ID},
+		{"revoke", "vrty_unknown_secret"},
+	} {
+		if _, err := runKeys(t, append([]string{"-config", path}, args...)...); err == nil {
+			t.Errorf("keys %v succeeded", args)
+		}
+	}
+	if _, ok := readKey(t, path, keys.ID); !ok {
+		t.Error("failed commands changed the config")
+	}
+}
+
+func TestLookupKey(t *testing.T) {
+	path, keys := newKeysConfig(t)
+	config, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyID := legacyKeyID(legacyTestKey)
+	config.APIKeys[legacyID] = APIKey{}
+
+	tests := []struct {
+		name   string
+		apiKey string
+		wantID string
+	}{
+		{"ID", keys.ID, keys.ID},
+		{"site key", keys.SiteKey, keys.ID},
+		{"secret key", keys.SecretKey, keys.ID},
+		{"legacy site key", legacyTestKey, legacyID},
+		{"unknown ID", "0123abcd", ""},
+		{"site key of unknown ID", "vrty_0123abcd_s3cr3t", ""},
+		{"secret key of unknown ID", "vrty_sk_0123abcd_s3cr3t", ""},
+	}
+	for _, tt := range tests {
+		id, _, err := lookupKey(config, tt.apiKey)
+		if tt.wantID == "" {
+			if err == nil {
+				t.Errorf("%s: lookupKey found %s", tt.name, id)
+			}
+			continue
+		}
+		if err != nil || id != tt.wantID {
+			t.Errorf("%s: lookupKey = %q, %v; want %q", tt.name, id, err, tt.wantID)
+		}
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,9 +14,16 @@ import (
 	"time"
 )
 
-var cm *ChallengeManager
-
 func main() {
+	// Run a command instead of the server if one is given
+	if handled, err := runCommand(os.Args[1:]); handled {
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Load configuration
 	config, err := LoadConfig()
 	if err != nil {
@@ -25,39 +32,21 @@ func main() {
 	}
 	log.Println("Loaded config.")
 
+	// Create replay store to prevent replay attacks
+	challenges, err := NewChallengeManager(*config)
+	if err != nil {
+		log.Printf("Error while creating replay store: %v", err)
+		return
+	}
+	defer challenges.Close()
+	log.Printf("Using %s replay store.", config.ReplayStore)
+
 	// Create server
-	server := NewServer(*config)
-	rateLimiter := NewRateLimiter()
+	server := NewServer(*config, challenges)
+	defer server.Close()
 
 	// Setup router
-	r := chi.NewRouter()
-
-	// Middleware
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.RequestID)
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"}, // We'll validate in our middleware
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
-	r.Use(rateLimiter.RateLimitMiddleware)
-	r.Use(middleware.Logger)
-
-	// Public routes
-	r.Get("/", server.handleRoot)
-
-	// API routes with key validation
-	r.Route("/api/v1", func(r chi.Router) {
-		r.Group(func(r chi.Router) {
-			r.Use(server.APIKeyMiddleware)
-			r.Get("/challenge", server.handleGetChallenge)
-			r.Post("/challenge/verify", server.handleVerifyChallenge)
-		})
-	})
+	r := server.setupRouter()
 
 	// Setup server
 	srv := &http.Server{
@@ -68,27 +57,33 @@ func main() {
 		IdleTimeout:  30 * time.Second,
 	}
 
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Printf("Error while listening on %s: %v", srv.Addr, err)
+		return
+	}
+	if config.ProxyProtocol {
+		listener = NewProxyProtocolListener(listener, server.proxies)
+		log.Println("Accepting PROXY protocol headers from trusted proxies.")
+	}
+
 	// Start server in a goroutine
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
 	log.Printf("Server started on port %d", config.Port)
 
-	//Schedule challenge manager to prevent replay attacks
-	cm = NewChallengeManager(server.config.ExpireTime)
-	log.Printf("Scheduled challenge manager to run every %s.", server.config.ExpireTime)
-
 	// Handle graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
 
-	// Save stats on shutdown
-	if err := SaveConfig("./verity.yaml", &server.config); err != nil {
-		log.Printf("Error saving configuration: %v", err)
+	// Save stats on shutdown, on top of the periodic saves
+	if err := server.SaveStats(); err != nil {
+		log.Printf("Error saving stats: %v", err)
 	}
 
 	// Create context with timeout for shutdown
@@ -101,3 +96,19 @@ func main() {
 
 	log.Println("Server stopped")
 }
+
+// runCommand runs the command named by the first argument, and reports
+// whether there was one
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "add":
+		return true, runAddCommand(args[1:])
+	case "keys":
+		return true, runKeysCommand(args[1:])
+	default:
+		return false, nil
+	}
+}
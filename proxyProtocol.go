@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted peer may take to send its
+// PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener accepts connections carrying a PROXY protocol v1 or
+// v2 header, as sent by load balancers such as HAProxy. Headers are only
+// read from trusted peers, and the connection's remote address becomes the
+// source address from the header.
+type ProxyProtocolListener struct {
+	net.Listener
+	trusted *TrustedProxies
+	conns   chan net.Conn
+	err     chan error
+}
+
+// NewProxyProtocolListener wraps a listener. Headers are read in the
+// background, so a slow peer can't hold up other connections.
+func NewProxyProtocolListener(listener net.Listener, trusted *TrustedProxies) *ProxyProtocolListener {
+	pl := &ProxyProtocolListener{
+		Listener: listener,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+// Accept returns the next connection whose header has been read
+func (pl *ProxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.err:
+		// Keep the error for later calls
+		pl.err <- err
+		return nil, err
+	}
+}
+
+func (pl *ProxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			pl.err <- err
+			return
+		}
+		go pl.handshake(conn)
+	}
+}
+
+// handshake reads the PROXY header of a trusted peer and hands the
+// connection to Accept
+func (pl *ProxyProtocolListener) handshake(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	peer := net.ParseIP(host)
+	if peer == nil || !pl.trusted.Contains(peer) {
+		pl.deliver(conn)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	source, err := readProxyHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Dropping connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	pl.deliver(&proxyConn{Conn: conn, reader: reader, remoteAddr: source})
+}
+
+// deliver passes a connection to Accept, or closes it if the listener is
+// closed in the meantime
+func (pl *ProxyProtocolListener) deliver(conn net.Conn) {
+	select {
+	case pl.conns <- conn:
+	case err := <-pl.err:
+		pl.err <- err
+		conn.Close()
+	}
+}
+
+// proxyConn is a connection whose remote address comes from a PROXY header
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the source address from the PROXY header, or the peer
+// address for LOCAL and UNKNOWN connections
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address, which is nil if the header carries none
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	return readProxyHeaderV1(reader)
+}
+
+// readProxyHeaderV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary PROXY protocol v2 header
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+
+	// LOCAL connections, such as health checks, keep the peer address
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported PROXY command %d", command)
+	}
+
+	switch family {
+	case 0x1: // IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short PROXY address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short PROXY address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// Unix sockets and unspecified families carry no usable IP
+		return nil, nil
+	}
+}
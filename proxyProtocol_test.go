@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header with the given version
+// and command, address family and address block. length overrides the
+// length of the block if it isn't negative.
+func proxyV2Header(versionCommand, family byte, block []byte, length int) string {
+	if length < 0 {
+		length = len(block)
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, versionCommand, family<<4|0x1)
+	header = binary.BigEndian.AppendUint16(header, uint16(length))
+	return string(append(header, block...))
+}
+
+// addressBlock returns a v2 address block for a source and destination
+// address and port
+func addressBlock(src, dst string, srcPort, dstPort uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if v4 := srcIP.To4(); v4 != nil {
+		srcIP, dstIP = v4, dstIP.To4()
+	}
+	block := append(append([]byte{}, srcIP...), dstIP...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	const (
+		proxyCommand = 0x21
+		localCommand = 0x20
+		ipv4         = 0x1
+		ipv6         = 0x2
+	)
+	v4Block := addressBlock("192.0.2.1", "198.51.100.1", 56324, 443)
+	v6Block := addressBlock("2001:db8::1", "2001:db8::2", 56324, 443)
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string // Source address, empty for none
+		wantErr bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+		{"v1 without CR", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", true},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", true},
+		{"v1 bad address", "PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", "", true},
+		{"not a PROXY header", "GET / HTTP/1.1\r\n", "", true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1", "", true},
+		{"v2 IPv4", proxyV2Header(proxyCommand, ipv4, v4Block, -1), "192.0.2.1:56324", false},
+		{"v2 IPv6", proxyV2Header(proxyCommand, ipv6, v6Block, -1), "[2001:db8::1]:56324", false},
+		{"v2 with TLVs", proxyV2Header(proxyCommand, ipv4, append(v4Block, 0x04, 0x00, 0x01, 0x00), -1), "192.0.2.1:56324", false},
+		{"v2 LOCAL", proxyV2Header(localCommand, 0x0, nil, -1), "", false},
+		{"v2 LOCAL with addresses", proxyV2Header(localCommand, ipv4, v4Block, -1), "", false},
+		{"v2 unspecified family", proxyV2Header(proxyCommand, 0x0, nil, -1), "", false},
+		{"v2 truncated IPv4 block", proxyV2Header(proxyCommand, ipv4, v4Block[:8], -1), "", true},
+		{"v2 truncated IPv6 block", proxyV2Header(proxyCommand, ipv6, v6Block[:20], -1), "", true},
+		{"v2 IPv6 family with IPv4 block", proxyV2Header(proxyCommand, ipv6, v4Block, -1), "", true},
+		{"v2 oversized length", proxyV2Header(proxyCommand, ipv4, v4Block, 0xffff), "", true},
+		{"v2 truncated header", proxyV2Header(proxyCommand, ipv4, nil, -1)[:14], "", true},
+		{"v2 wrong version", proxyV2Header(0x11, ipv4, v4Block, -1), "", true},
+		{"v2 unknown command", proxyV2Header(0x22, ipv4, v4Block, -1), "", true},
+	}
+	for _, tt := range tests {
+		// The request after the header must be left for the server
+		const request = "GET / HTTP/1.1\r\n\r\n"
+		reader := bufio.NewReader(strings.NewReader(tt.header + request))
+		addr, err := readProxyHeader(reader)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: readProxyHeader = %v, want an error", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readProxyHeader error: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: source = %q, want %q", tt.name, got, tt.want)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != request {
+			t.Errorf("%s: left %q after the header, want %q", tt.name, rest, request)
+		}
+	}
+}
@@ -1,100 +1,460 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 // ContextKey type for context keys
 type ContextKey string
 
 const (
-	// APIKeyContextKey is the context key for API key
+	// APIKeyContextKey is the context key for the ID of the API key
 	APIKeyContextKey ContextKey = "apiKey"
+	// SecretKeyContextKey is the context key for whether the request was
+	// made with the secret key of its API key
+	SecretKeyContextKey ContextKey = "secretKey"
+)
 
-	// RequestLimitWindow is the time window for rate limiting
-	RequestLimitWindow = 10 * time.Minute
-
-	// MaxRequestsPerIP is the maximum number of requests per IP in the time window
-	MaxRequestsPerIP = 100
+// Places a request may carry its API key in
+const (
+	// KeySourceBearer is the Authorization header, as a bearer token
+	KeySourceBearer = "bearer"
+	// KeySourceHeader is the X-Verity-Key header
+	KeySourceHeader = "header"
+	// KeySourceForm is the apiKey field of a form body
+	KeySourceForm = "form"
+	// KeySourceQuery is the apiKey query parameter
+	KeySourceQuery = "query"
 )
 
+// DefaultAPIKeySources lists the places an API key is looked for, headers
+// first, as the query string tends to end up in access logs
+var DefaultAPIKeySources = []string{KeySourceBearer, KeySourceHeader, KeySourceForm, KeySourceQuery}
+
+// validateKeySources checks that sources only names known key sources
+func validateKeySources(sources []string) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("apiKeySources must not be empty")
+	}
+	for _, source := range sources {
+		switch source {
+		case KeySourceBearer, KeySourceHeader, KeySourceForm, KeySourceQuery:
+		default:
+			return fmt.Errorf("invalid apiKeySources entry: %s", source)
+		}
+	}
+	return nil
+}
+
+// requestAPIKey returns the API key of a request from the first of sources
+// that carries one
+func requestAPIKey(r *http.Request, sources []string) string {
+	for _, source := range sources {
+		var apiKey string
+		switch source {
+		case KeySourceBearer:
+			scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+			if found && strings.EqualFold(scheme, "Bearer") {
+				apiKey = token
+			}
+		case KeySourceHeader:
+			apiKey = r.Header.Get("X-Verity-Key")
+		case KeySourceForm:
+			apiKey = formAPIKey(r)
+		case KeySourceQuery:
+			apiKey = r.URL.Query().Get("apiKey")
+		}
+		if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+			return apiKey
+		}
+	}
+	return ""
+}
+
+// formAPIKey returns the apiKey field of a form body. The form is parsed
+// from a copy of the body, so handlers still get the whole body: clients
+// often send a bare solution with a form content type.
+func formAPIKey(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body == nil || (mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data") {
+		return ""
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		// Leave the error, such as a body too large, for the handler
+		r.Body = io.NopCloser(errorReader{err})
+		return ""
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	form := r.Clone(r.Context())
+	form.Body = io.NopCloser(bytes.NewReader(body))
+	apiKey := form.PostFormValue("apiKey")
+	if form.MultipartForm != nil {
+		form.MultipartForm.RemoveAll()
+	}
+	return apiKey
+}
+
+// errorReader fails every read with err
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// RedactAPIKeyMiddleware hides API keys passed in the query string, as
+// apiKey or as the siteverify secret, from the request logger, which must
+// come after it
+func RedactAPIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if redacted, changed := redactQuery(r.URL.RawQuery); changed {
+			logged := *r
+			logged.RequestURI = r.URL.EscapedPath() + "?" + redacted
+			r = &logged
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactQuery replaces the value of any apiKey or secret parameter in a raw
+// query
+func redactQuery(rawQuery string) (string, bool) {
+	params := strings.Split(rawQuery, "&")
+	changed := false
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); err == nil && (name == "apiKey" || name == "secret") {
+			params[i] = name + "=REDACTED"
+			changed = true
+		}
+	}
+	return strings.Join(params, "&"), changed
+}
+
+// Rate is a number of requests allowed per period
+type Rate struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseRate parses a rate such as "100/10m" or "5/s"
+func ParseRate(s string) (Rate, error) {
+	requests, period, found := strings.Cut(s, "/")
+	if !found {
+		return Rate{}, fmt.Errorf("rate must look like 100/10m")
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(requests))
+	if err != nil || count <= 0 {
+		return Rate{}, fmt.Errorf("rate must allow at least one request")
+	}
+
+	// Allow a bare unit, such as "s" for "1s"
+	period = strings.TrimSpace(period)
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate period: %s", period)
+	}
+
+	return Rate{Requests: count, Period: duration}, nil
+}
+
+// interval returns the time between two requests at the steady rate
+func (r Rate) interval() time.Duration {
+	return r.Period / time.Duration(r.Requests)
+}
+
 // RateLimiter implements rate limiting
 type RateLimiter struct {
-	ipLimits map[string]*ipRateLimit
-	mutex    sync.Mutex
+	ipLimits *ShardedMap[ipRateLimit]
+	ipKeys   IPKeyer
+	access   *AccessRules
+	rate     Rate
+	burst    int
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter() *RateLimiter {
+// NewRateLimiter creates a new rate limiter allowing rate requests per IP,
+// with bursts of up to burst requests. IPs are grouped by ipKeys, and at
+// most maxIPs groups are tracked, 0 meaning unbounded. Denylisted IPs are
+// blocked and allowlisted IPs are not limited.
+func NewRateLimiter(rate Rate, burst int, maxIPs int, ipKeys IPKeyer, access *AccessRules) *RateLimiter {
 	return &RateLimiter{
-		ipLimits: make(map[string]*ipRateLimit),
+		ipLimits: NewShardedMap[ipRateLimit](maxIPs),
+		ipKeys:   ipKeys,
+		access:   access,
+		rate:     rate,
+		burst:    burst,
 	}
 }
 
-// APIKeyMiddleware validates the API key and origin
-func (s *Server) APIKeyMiddleware(next http.Handler) http.Handler {
+// apiError is the reason a request was rejected
+type apiError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+}
+
+// APIKeyMiddleware validates the API key and origin, and stores the key's
+// ID in the request context. Only keys allowed scope are accepted.
+func (s *Server) APIKeyMiddleware(scope KeyScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented := requestAPIKey(r, s.config.APIKeySources)
+			apiKey, apiErr := s.authenticateKey(r, presented, scope)
+			if apiErr != nil {
+				writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
+				return
+			}
+
+			// Store API key in context
+			ctx := context.WithValue(r.Context(), APIKeyContextKey, apiKey)
+			ctx = context.WithValue(ctx, SecretKeyContextKey, strings.HasPrefix(presented, secretKeyPrefix))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// SiteVerifyKeyMiddleware validates the secret key sent in the secret
+// field of siteverify requests and stores the key's ID in the request
+// context. Only secret keys are accepted, also for keys that can still
+// verify with their site key.
+func (s *Server) SiteVerifyKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.URL.Query().Get("apiKey")
-		if apiKey == "" {
-			writeErrorResponse(w, "Missing API key", http.StatusUnauthorized)
+		if err := r.ParseForm(); err != nil {
+			apiErr := bodyError(err, "Invalid form body")
+			writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
 			return
 		}
-
-		if !strings.HasPrefix(apiKey, "vrty_") {
-			writeErrorResponse(w, "Invalid API key format", http.StatusUnauthorized)
+		secret := strings.TrimSpace(r.FormValue("secret"))
+		if secret == "" {
+			writeError(w, r, http.StatusUnauthorized, CodeMissingKey, "Missing secret")
+			return
+		}
+		if !strings.HasPrefix(secret, secretKeyPrefix) {
+			writeError(w, r, http.StatusUnauthorized, CodeWrongScope,
+				"The secret must be a secret key starting with "+secretKeyPrefix+"; issue one with keys rotate-secret")
+			return
+		}
+		apiKey, apiErr := s.authenticateKey(r, secret, KeyScopeVerify)
+		if apiErr != nil {
+			writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
 			return
 		}
 
-		s.mutex.RLock()
-		allowedOrigins, exists := s.config.APIKeys[apiKey]
-		s.mutex.RUnlock()
+		ctx := context.WithValue(r.Context(), APIKeyContextKey, apiKey)
+		ctx = context.WithValue(ctx, SecretKeyContextKey, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-		if !exists {
-			writeErrorResponse(w, "Invalid API key", http.StatusUnauthorized)
+// BodyLimitMiddleware limits request bodies to maxBodyBytes. It must run
+// before anything reads the body, including form parsing for API keys.
+func (s *Server) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.config.MaxBodyBytes {
+			writeError(w, r, http.StatusRequestEntityTooLarge, CodeTooLarge, "Request body too large")
 			return
 		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateKey checks the API key presented with a request for scope,
+// and returns its ID. Secret keys are used by backends rather than
+// browsers, so their origin isn't checked.
+func (s *Server) authenticateKey(r *http.Request, presented string, scope KeyScope) (string, *apiError) {
+	if presented == "" {
+		return "", &apiError{http.StatusUnauthorized, CodeMissingKey, "Missing API key"}
+	}
 
-		valid := false
-		origin := r.Header.Get("Origin")
+	secretKey := strings.HasPrefix(presented, secretKeyPrefix)
+	parse := parseAPIKey
+	if secretKey {
+		parse = parseSecretKey
+	}
+	apiKey, secret, ok := parse(presented)
+	if !ok {
+		return "", &apiError{http.StatusUnauthorized, CodeInvalidKey, "Invalid API key format"}
+	}
 
-		if origin != "" {
-			for _, allowedOrigin := range allowedOrigins {
-				if origin == allowedOrigin || allowedOrigin == "*" {
-					valid = true
-					break
-				}
-			}
-		}
+	key, exists := s.apiKey(apiKey)
+	check := key.checkSecret
+	if secretKey {
+		check = key.checkSecretKey
+	}
+	if !exists || !check(secret) {
+		return "", &apiError{http.StatusUnauthorized, CodeInvalidKey, "Invalid API key"}
+	}
 
-		if !valid {
-			writeErrorResponse(w, "Invalid origin", http.StatusForbidden)
-			return
+	if !key.allows(scope, secretKey) {
+		if secretKey {
+			return "", &apiError{http.StatusForbidden, CodeWrongScope, "Secret keys can only verify challenges"}
 		}
+		return "", &apiError{http.StatusForbidden, CodeWrongScope, "Site keys cannot verify challenges; use the secret key"}
+	}
 
-		// Store API key in context
-		ctx := context.WithValue(r.Context(), APIKeyContextKey, apiKey)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	if !key.Enabled {
+		return "", &apiError{http.StatusForbidden, CodeKeyDisabled, "API key disabled"}
+	}
+
+	if key.Expired(time.Now()) {
+		return "", &apiError{http.StatusUnauthorized, CodeKeyExpired, "API key expired"}
+	}
+
+	// The lists of a key are meant for the clients of its site, not for the
+	// backends verifying with the secret key
+	if !secretKey && s.keyAccess[apiKey].Check(GetRealIP(r)) == AccessDenied {
+		s.updateStats(apiKey, func(stats *StatsEntry) {
+			stats.BlockedRequests++
+		})
+		return "", &apiError{http.StatusForbidden, CodeIPBlocked, "IP address blocked"}
+	}
+
+	if !secretKey && !key.allowsOrigin(r.Header.Get("Origin")) {
+		return "", &apiError{http.StatusForbidden, CodeOriginMismatch, "Invalid origin"}
+	}
+
+	return apiKey, nil
 }
 
 // RateLimitMiddleware implements rate limiting by IP
 func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := GetRealIP(r)
+		switch rl.access.Check(GetRealIP(r)) {
+		case AccessDenied:
+			rl.access.countBlocked()
+			writeError(w, r, http.StatusForbidden, CodeIPBlocked, "IP address blocked")
+			return
+		case AccessAllowed:
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		rl.mutex.Lock()
-		allowed := LimitByIP(ip, MaxRequestsPerIP, RequestLimitWindow, rl.ipLimits)
-		rl.mutex.Unlock()
+		ip := rl.ipKeys.Key(GetRealIP(r))
+		result := LimitByIP(ip, rl.rate, rl.burst, rl.ipLimits)
+		setRateLimitHeaders(w, result)
 
-		if !allowed {
-			writeErrorResponse(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		if !result.Allowed {
+			writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Rate limit exceeded")
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// KeyRateLimitMiddleware implements rate limiting by API key. It must run
+// after APIKeyMiddleware.
+func (s *Server) KeyRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, _ := r.Context().Value(APIKeyContextKey).(string)
+		key, _ := s.apiKey(apiKey)
+
+		if key.RateLimit != "" && !s.allowlisted(apiKey, GetRealIP(r)) {
+			rate, err := ParseRate(key.RateLimit)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Invalid API key rate limit")
+				return
+			}
+			burst := key.Burst
+			if burst < 1 {
+				burst = 1
+			}
+			result := LimitByIP(apiKey, rate, burst, s.keyLimits)
+			// Report whichever of the IP and key limits is closer to running out
+			remaining, err := strconv.Atoi(w.Header().Get("RateLimit-Remaining"))
+			if !result.Allowed || err != nil || result.Remaining < remaining {
+				setRateLimitHeaders(w, result)
+			}
+			if !result.Allowed {
+				writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "API key rate limit exceeded")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// QuotaMiddleware enforces the daily and monthly challenge quotas of an API
+// key. A request is counted when it passes, so concurrent requests can't
+// overrun the quota, and refunded if no challenge was issued. It must run
+// after APIKeyMiddleware.
+func (s *Server) QuotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, _ := r.Context().Value(APIKeyContextKey).(string)
+		key, _ := s.apiKey(apiKey)
+
+		now := time.Now().UTC()
+		day := now.Format("2006-01-02")
+		month := now.Format("2006-01")
+		exceeded := ""
+		var retryAt time.Time
+
+		s.updateStats(apiKey, func(stats *StatsEntry) {
+			// Start counting again when a new day or month begins
+			if stats.QuotaDay != day {
+				stats.QuotaDay = day
+				stats.DailyChallenges = 0
+			}
+			if stats.QuotaMonth != month {
+				stats.QuotaMonth = month
+				stats.MonthlyChallenges = 0
+			}
+
+			if key.DailyQuota > 0 && stats.DailyChallenges >= key.DailyQuota {
+				exceeded = "Daily challenge quota exceeded"
+				retryAt = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+				return
+			}
+			if key.MonthlyQuota > 0 && stats.MonthlyChallenges >= key.MonthlyQuota {
+				exceeded = "Monthly challenge quota exceeded"
+				retryAt = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+				return
+			}
+
+			stats.DailyChallenges++
+			stats.MonthlyChallenges++
+		})
+
+		if exceeded != "" {
+			w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(retryAt.Sub(now)), 10))
+			writeError(w, r, http.StatusTooManyRequests, CodeQuotaExceeded, exceeded)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		if ww.Status() < http.StatusBadRequest {
+			return
+		}
+		s.updateStats(apiKey, func(stats *StatsEntry) {
+			// Unless the count was reset meanwhile
+			if stats.QuotaDay == day && stats.DailyChallenges > 0 {
+				stats.DailyChallenges--
+			}
+			if stats.QuotaMonth == month && stats.MonthlyChallenges > 0 {
+				stats.MonthlyChallenges--
+			}
+		})
+	})
+}
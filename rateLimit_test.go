@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestQuotaMiddlewareCountsIssuedChallenges(t *testing.T) {
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		for id, key := range config.APIKeys {
+			key.DailyQuota = 2
+			config.APIKeys[id] = key
+		}
+	})
+
+	status := http.StatusInternalServerError
+	handler := s.QuotaMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	request := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+		req = req.WithContext(context.WithValue(req.Context(), APIKeyContextKey, keys.ID))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Failed requests are refunded
+	for i := 0; i < 5; i++ {
+		request()
+	}
+	if used := s.Stats()[keys.ID].DailyChallenges; used != 0 {
+		t.Fatalf("failed requests used %d of the quota, want 0", used)
+	}
+
+	status = http.StatusOK
+	for i := 0; i < 2; i++ {
+		if code := request(); code != http.StatusOK {
+			t.Fatalf("request %d within quota = %d", i+1, code)
+		}
+	}
+	if code := request(); code != http.StatusTooManyRequests {
+		t.Fatalf("request over quota = %d, want 429", code)
+	}
+	if used := s.Stats()[keys.ID].DailyChallenges; used != 2 {
+		t.Errorf("DailyChallenges = %d, want 2", used)
+	}
+}
+
+func TestSaveStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	if err := ensureConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		config.Path = path
+	})
+	err := UpdateConfig(path, func(config *ServerConfig) error {
+		config.APIKeys[keys.ID] = s.config.APIKeys[keys.ID]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.updateStats(keys.ID, func(stats *StatsEntry) {
+		stats.DailyChallenges = 7
+	})
+	s.updateStats("removed-key", func(stats *StatsEntry) {
+		stats.DailyChallenges = 1
+	})
+	if err := s.SaveStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.Stats[keys.ID].DailyChallenges; got != 7 {
+		t.Errorf("saved DailyChallenges = %d, want 7", got)
+	}
+	if _, exists := saved.Stats["removed-key"]; exists {
+		t.Error("stats saved for a key missing from the config file")
+	}
+}
+
+func TestSaveStatsDropsIPCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verity.yaml")
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		config.Path = path
+	})
+
+	// Older versions saved per-IP counts with the stats of each key
+	oldConfig := `hmacKey: test-hmac-key
+apiKeys:
+  ` + keys.ID + `:
+    hash: "11"
+stats:
+  ` + keys.ID + `:
+    totalChallenges: 3
+    ipThrottleCount:
+      192.0.2.1: 5
+`
+	if err := os.WriteFile(path, []byte(oldConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.countIPChallenge(keys.ID, "198.51.100.7")
+	s.updateStats(keys.ID, func(stats *StatsEntry) {
+		stats.TotalChallenges = 4
+	})
+	if err := s.SaveStats(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "192.0.2.1") || strings.Contains(string(raw), "198.51.100.7") {
+		t.Errorf("per-IP counts saved to the config file:\n%s", raw)
+	}
+	saved, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.Stats[keys.ID].TotalChallenges; got != 4 {
+		t.Errorf("saved TotalChallenges = %d, want 4", got)
+	}
+}
+
+func TestRequestAPIKeyFormKeepsBody(t *testing.T) {
+	var multipartBody bytes.Buffer
+	writer := multipart.NewWriter(&multipartBody)
+	writer.WriteField("apiKey", "vrty_form")
+	writer.WriteField("altcha", "c29sdXRpb24=")
+	writer.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"form", "application/x-www-form-urlencoded", "apiKey=vrty_form&altcha=c29sdXRpb24%3D", "vrty_form"},
+		{"bare solution as form", "application/x-www-form-urlencoded", "eyJhbGdvcml0aG0iOiJTSEEtMjU2In0=", ""},
+		{"multipart", writer.FormDataContentType(), multipartBody.String(), "vrty_form"},
+		{"JSON", "application/json", `{"apiKey":"vrty_form"}`, ""},
+		{"no content type", "", "apiKey=vrty_form", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/challenge/verify", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if got := requestAPIKey(req, []string{KeySourceForm}); got != tt.want {
+				t.Errorf("requestAPIKey = %q, want %q", got, tt.want)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil || string(body) != tt.body {
+				t.Errorf("body after reading the key = %q, %v; want %q", body, err, tt.body)
+			}
+		})
+	}
+
+	// A body over the limit is left for the handler to reject
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/challenge/verify", strings.NewReader("apiKey="+strings.Repeat("x", 100)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = http.MaxBytesReader(rec, req.Body, 10)
+	if got := requestAPIKey(req, []string{KeySourceForm}); got != "" {
+		t.Errorf("requestAPIKey read %q from a body over the limit", got)
+	}
+	var tooLarge *http.MaxBytesError
+	if _, err := io.ReadAll(req.Body); !errors.As(err, &tooLarge) {
+		t.Errorf("reading the body over the limit = %v, want a MaxBytesError", err)
+	}
+}
+
+func TestKeyAccessListsSkipSecretKey(t *testing.T) {
+	const blockedIP = "198.51.100.7"
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		for id, key := range config.APIKeys {
+			key.DenyList = []string{blockedIP}
+			config.APIKeys[id] = key
+		}
+	})
+	handler := testRouter(s)
+	solution := newSolution(t, handler, keys)
+
+	// The site key is refused from a denied IP
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+	req.Header.Set("Authorization", "Bearer "+keys.SiteKey)
+	req.Header.Set("Origin", testOrigin)
+	req.RemoteAddr = blockedIP + ":1234"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || decodeError(t, rec) != CodeIPBlocked {
+		t.Errorf("challenge from a denied IP = %d, want 403 %s", rec.Code, CodeIPBlocked)
+	}
+
+	// A backend verifying from that IP is not the client the list is for
+	req = newVerifyRequest("/api/v2/challenge/verify", "", solution, keys.SecretKey)
+	req.RemoteAddr = blockedIP + ":1234"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("verify from a denied IP with the secret key = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipBurst    int
+		keyLimit   string
+		keyBurst   int
+		wantLimit  string
+		wantReason string // Message of the 429 response
+	}{
+		{"IP limit only", 2, "", 0, "2", "Rate limit exceeded"},
+		{"IP limit tighter", 2, "1/1h", 5, "2", "Rate limit exceeded"},
+		{"key limit tighter", 5, "1/1h", 2, "2", "API key rate limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+				config.ChallengeRate, config.ChallengeBurst = "1/1h", tt.ipBurst
+				for id, key := range config.APIKeys {
+					key.RateLimit, key.Burst = tt.keyLimit, tt.keyBurst
+					config.APIKeys[id] = key
+				}
+			})
+			handler := testRouter(s)
+
+			for i, wantRemaining := range []string{"1", "0", "0"} {
+				req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+				req.Header.Set("Authorization", "Bearer "+keys.SiteKey)
+				req.Header.Set("Origin", testOrigin)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+
+				header := rec.Header()
+				if header.Get("RateLimit-Limit") != tt.wantLimit || header.Get("RateLimit-Remaining") != wantRemaining || header.Get("RateLimit-Reset") == "" {
+					t.Errorf("request %d: RateLimit headers = %q, %q, %q; want limit %s, %s remaining", i+1,
+						header.Get("RateLimit-Limit"), header.Get("RateLimit-Remaining"), header.Get("RateLimit-Reset"), tt.wantLimit, wantRemaining)
+				}
+				if i < 2 {
+					if rec.Code != http.StatusOK || header.Get("Retry-After") != "" {
+						t.Errorf("request %d: status %d, Retry-After %q; want 200 without Retry-After", i+1, rec.Code, header.Get("Retry-After"))
+					}
+					continue
+				}
+				var body ErrorResponse
+				json.Unmarshal(rec.Body.Bytes(), &body)
+				if rec.Code != http.StatusTooManyRequests || body.Message != tt.wantReason {
+					t.Errorf("request over the limit: %d %q, want 429 %q", rec.Code, body.Message, tt.wantReason)
+				}
+				if header.Get("Retry-After") != "3600" {
+					t.Errorf("Retry-After = %q, want 3600", header.Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyRejections(t *testing.T) {
+	challenge := func(apiKey string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("Origin", testOrigin)
+		return req
+	}
+	verify := func(apiKey string) *http.Request {
+		req := newVerifyRequest("/api/v2/challenge/verify", "text/plain", "solution", apiKey)
+		req.Header.Set("Origin", testOrigin)
+		return req
+	}
+
+	tests := []struct {
+		name       string
+		key        func(key *APIKey)
+		request    func(keys testKeys) *http.Request
+		wantStatus int
+		wantCode   ErrorCode
+	}{
+		{"disabled key requesting a challenge", func(key *APIKey) { key.Enabled = false },
+			func(keys testKeys) *http.Request { return challenge(keys.SiteKey) }, http.StatusForbidden, CodeKeyDisabled},
+		{"disabled key verifying", func(key *APIKey) { key.Enabled = false },
+			func(keys testKeys) *http.Request { return verify(keys.SecretKey) }, http.StatusForbidden, CodeKeyDisabled},
+		{"expired key requesting a challenge", func(key *APIKey) { key.ExpiresAt = time.Now().Add(-time.Minute) },
+			func(keys testKeys) *http.Request { return challenge(keys.SiteKey) }, http.StatusUnauthorized, CodeKeyExpired},
+		{"expired key verifying", func(key *APIKey) { key.ExpiresAt = time.Now().Add(-time.Minute) },
+			func(keys testKeys) *http.Request { return verify(keys.SecretKey) }, http.StatusUnauthorized, CodeKeyExpired},
+		{"key expiring later", func(key *APIKey) { key.ExpiresAt = time.Now().Add(time.Hour) },
+			func(keys testKeys) *http.Request { return challenge(keys.SiteKey) }, http.StatusOK, ""},
+		{"site key verifying", func(*APIKey) {},
+			func(keys testKeys) *http.Request { return verify(keys.SiteKey) }, http.StatusForbidden, CodeWrongScope},
+		{"secret key requesting a challenge", func(*APIKey) {},
+			func(keys testKeys) *http.Request { return challenge(keys.SecretKey) }, http.StatusForbidden, CodeWrongScope},
+		{"site key without a secret key verifying", func(key *APIKey) { key.SecretKeySalt, key.SecretKeyHash = "", "" },
+			func(keys testKeys) *http.Request { return verify(keys.SiteKey) }, http.StatusBadRequest, CodeMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+				for id, key := range config.APIKeys {
+					tt.key(&key)
+					config.APIKeys[id] = key
+				}
+			})
+			rec := httptest.NewRecorder()
+			testRouter(s).ServeHTTP(rec, tt.request(keys))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				if code := decodeError(t, rec); code != tt.wantCode {
+					t.Errorf("error = %q, want %q", code, tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyExpiresWhileRunning(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		for id, key := range config.APIKeys {
+			key.ExpiresAt = time.Now().Add(lifetime)
+			config.APIKeys[id] = key
+		}
+	})
+	handler := testRouter(s)
+
+	requestChallenge(t, handler, keys)
+	time.Sleep(lifetime)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/challenge", nil)
+	req.Header.Set("Authorization", "Bearer "+keys.SiteKey)
+	req.Header.Set("Origin", testOrigin)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var body Response
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusUnauthorized || body.Message != "API key expired" {
+		t.Errorf("request after expiry = %d %q, want 401 API key expired", rec.Code, body.Message)
+	}
+}
+
+func TestSiteVerifyRejectsSiteKeys(t *testing.T) {
+	s, keys := newTestServer(t, newTestMemoryStore(t), nil)
+	form := url.Values{"secret": {keys.SiteKey}, "response": {"solution"}}
+	req := newVerifyRequest("/api/v1/siteverify", "application/x-www-form-urlencoded", form.Encode(), "")
+	rec := httptest.NewRecorder()
+	testRouter(s).ServeHTTP(rec, req)
+
+	var reply SiteVerifyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Success || len(reply.ErrorCodes) != 1 || reply.ErrorCodes[0] != "invalid-input-secret" || !strings.Contains(reply.Message, "secret key") {
+		t.Errorf("siteverify with a site key = %+v", reply)
+	}
+}
+
+func TestRedactAPIKeyMiddleware(t *testing.T) {
+	var logged bytes.Buffer
+	defaultLogger := middleware.DefaultLogger
+	middleware.DefaultLogger = middleware.RequestLogger(&middleware.DefaultLogFormatter{
+		Logger:  log.New(&logged, "", 0),
+		NoColor: true,
+	})
+	t.Cleanup(func() { middleware.DefaultLogger = defaultLogger })
+
+	s, keys := newTestServer(t, newTestMemoryStore(t), nil)
+	handler := s.setupRouter()
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"apiKey", "foo=bar&apiKey=" + keys.SiteKey, "?foo=bar&apiKey=REDACTED "},
+		{"secret", "secret=" + keys.SecretKey + "&apiKey=" + keys.SiteKey + "&foo=bar", "?secret=REDACTED&apiKey=REDACTED&foo=bar "},
+		{"escaped name", "%61piKey=" + keys.SiteKey, "?apiKey=REDACTED "},
+		{"other parameters", "foo=bar&apiKeys=baz", "?foo=bar&apiKeys=baz "},
+	}
+	for _, tt := range tests {
+		logged.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge?"+tt.query, nil)
+		req.Header.Set("Origin", testOrigin)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		line := logged.String()
+		if !strings.Contains(line, "/api/v2/challenge"+tt.want) {
+			t.Errorf("%s: logged %q, want the query %q", tt.name, line, tt.want)
+		}
+		if strings.Contains(line, keys.SiteKey) || strings.Contains(line, keys.SecretKey) {
+			t.Errorf("%s: logged a key: %q", tt.name, line)
+		}
+		// Later handlers still see the key
+		if tt.name == "apiKey" && rec.Code != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", tt.name, rec.Code)
+		}
+	}
+}
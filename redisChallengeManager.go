@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// ReplayStoreRedis keeps solved challenges in a Redis-compatible server
+	ReplayStoreRedis = "redis"
+
+	// redisTimeout bounds dialing and each command round trip
+	redisTimeout = 2 * time.Second
+
+	// redisMaxIdle is the number of idle connections kept for reuse
+	redisMaxIdle = 16
+)
+
+// RedisChallengeManager is a replay store that speaks the Redis protocol, so
+// several Verity instances can share one set of solved challenges
+type RedisChallengeManager struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	idle     chan *redisConn
+}
+
+// NewRedisChallengeManager creates a replay store using the Redis server at
+// addr. The connection is checked once, so misconfiguration shows up at
+// startup rather than on the first verification.
+func NewRedisChallengeManager(addr, password string, db int, prefix string) (*RedisChallengeManager, error) {
+	cm := &RedisChallengeManager{
+		addr:     addr,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		idle:     make(chan *redisConn, redisMaxIdle),
+	}
+	if _, err := cm.do("PING"); err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %w", err)
+	}
+	return cm, nil
+}
+
+func (cm *RedisChallengeManager) AddChallenge(challenge string, expireAt int64) error {
+	_, err := cm.do("SET", cm.prefix+challenge, "1", "PX", redisTTL(expireAt))
+	return err
+}
+
+func (cm *RedisChallengeManager) Exists(challenge string) (bool, error) {
+	reply, err := cm.do("EXISTS", cm.prefix+challenge)
+	if err != nil {
+		return false, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected redis reply: %v", reply)
+	}
+	return count > 0, nil
+}
+
+func (cm *RedisChallengeManager) TryConsume(challenge string, expireAt int64) (bool, error) {
+	reply, err := cm.do("SET", cm.prefix+challenge, "1", "NX", "PX", redisTTL(expireAt))
+	if err != nil {
+		return false, err
+	}
+	// SET NX replies OK when the key was set, and nil when it already existed
+	return reply == "OK", nil
+}
+
+func (cm *RedisChallengeManager) Close() error {
+	for {
+		select {
+		case conn := <-cm.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a single command on a pooled connection. Idle connections may
+// have been closed by the server meanwhile, so a command failing on one is
+// retried on another, and at last on a newly dialed connection. A retried
+// SET NX may then find its own key, which reports a replay rather than
+// accepting a solution twice.
+func (cm *RedisChallengeManager) do(args ...string) (interface{}, error) {
+	for {
+		conn, reused, err := cm.get()
+		if err != nil {
+			return nil, err
+		}
+		reply, err := conn.do(args...)
+		var redisErr redisError
+		if err != nil && !errors.As(err, &redisErr) {
+			// The connection state is unknown after an I/O error
+			conn.Close()
+			if reused {
+				continue
+			}
+			return nil, err
+		}
+		cm.put(conn)
+		return reply, err
+	}
+}
+
+// get returns an idle connection, or dials a new one, and reports whether
+// the connection was idle
+func (cm *RedisChallengeManager) get() (*redisConn, bool, error) {
+	select {
+	case conn := <-cm.idle:
+		return conn, true, nil
+	default:
+	}
+
+	conn, err := cm.dial()
+	return conn, false, err
+}
+
+// dial opens a new connection, authenticated and on the configured database
+func (cm *RedisChallengeManager) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", cm.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if cm.password != "" {
+		if _, err := conn.do("AUTH", cm.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth failed: %w", err)
+		}
+	}
+	if cm.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(cm.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection to the idle pool, closing it if the pool is full
+func (cm *RedisChallengeManager) put(conn *redisConn) {
+	select {
+	case cm.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisTTL converts an expiry time in seconds to a PX argument in
+// milliseconds, rounded up so keys last until replayExpiry. Already expired
+// challenges still get a short TTL, since Redis rejects non-positive expiry
+// values.
+func redisTTL(expireAt int64) string {
+	ttl := int64((time.Until(replayExpiry(expireAt)) + time.Millisecond - 1) / time.Millisecond)
+	if ttl < 1000 {
+		ttl = 1000
+	}
+	return strconv.FormatInt(ttl, 10)
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a single connection speaking RESP, the Redis protocol
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads its reply. Replies are decoded to string,
+// int64, []interface{} or nil.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length: %w", err)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length: %w", err)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply type %q", line[0])
+	}
+}
+
+// readLine reads a CRLF terminated line without the terminator
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed redis reply")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, speaking just
+// enough RESP for the replay store
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	keys     map[string]time.Time
+	conns    []net.Conn
+	accepted int
+	failures map[string]string // Error replies by command name
+	lastTTL  int64             // PX argument of the last SET, in ms
+}
+
+// newFakeRedis starts a fake server, requiring password if it isn't empty
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: listener,
+		password: password,
+		keys:     make(map[string]time.Time),
+		failures: make(map[string]string),
+	}
+	t.Cleanup(f.close)
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, conn)
+		f.accepted++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+// handle answers the commands of one client. Commands are arrays of bulk
+// strings, which the client side reply parser reads as well.
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	client := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	authed := f.password == ""
+	for {
+		request, err := client.readReply()
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		command := strings.ToUpper(args[0])
+		var reply string
+		f.mu.Lock()
+		switch {
+		case f.failures[command] != "":
+			reply = "-" + f.failures[command] + "\r\n"
+		case command == "AUTH":
+			authed = len(args) == 2 && args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.execute(command, args[1:])
+		}
+		f.mu.Unlock()
+
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command on the key store. The caller must hold f.mu.
+func (f *fakeRedis) execute(command string, args []string) string {
+	now := time.Now()
+	for key, expireAt := range f.keys {
+		if !now.Before(expireAt) {
+			delete(f.keys, key)
+		}
+	}
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "EXISTS":
+		count := 0
+		for _, key := range args {
+			if _, ok := f.keys[key]; ok {
+				count++
+			}
+		}
+		return ":" + strconv.Itoa(count) + "\r\n"
+	case "SET":
+		if len(args) < 2 {
+			return "-ERR wrong number of arguments for 'set' command\r\n"
+		}
+		key, nx, ttl := args[0], false, int64(0)
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				if i+1 < len(args) {
+					ttl, _ = strconv.ParseInt(args[i+1], 10, 64)
+					i++
+				}
+			}
+		}
+		if ttl <= 0 {
+			return "-ERR invalid expire time in 'set' command\r\n"
+		}
+		if _, exists := f.keys[key]; exists && nx {
+			return "$-1\r\n"
+		}
+		f.keys[key] = now.Add(time.Duration(ttl) * time.Millisecond)
+		f.lastTTL = ttl
+		return "+OK\r\n"
+	default:
+		return "-ERR unknown command '" + command + "'\r\n"
+	}
+}
+
+// failCommand makes the server answer command with an error reply
+func (f *fakeRedis) failCommand(command, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[command] = message
+}
+
+// dropConnections closes every client connection, like a server restart
+// or an idle timeout would
+func (f *fakeRedis) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.accepted
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+	f.dropConnections()
+}
+
+func TestRedisChallengeManager(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cm, err := NewRedisChallengeManager(server.addr(), "", 0, "test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	expireAt := time.Now().Add(time.Minute).Unix()
+
+	if exists, err := cm.Exists("a"); err != nil || exists {
+		t.Fatalf("Exists before solving = %v, %v; want false", exists, err)
+	}
+	if consumed, err := cm.TryConsume("a", expireAt); err != nil || !consumed {
+		t.Fatalf("first TryConsume = %v, %v; want true", consumed, err)
+	}
+	server.mu.Lock()
+	ttl := server.lastTTL
+	server.mu.Unlock()
+	if ttl < 55000 || ttl > 61000 {
+		t.Errorf("SET PX = %d ms, want about a minute", ttl)
+	}
+	if consumed, err := cm.TryConsume("a", expireAt); err != nil || consumed {
+		t.Fatalf("second TryConsume = %v, %v; want false", consumed, err)
+	}
+	if exists, err := cm.Exists("a"); err != nil || !exists {
+		t.Fatalf("Exists after solving = %v, %v; want true", exists, err)
+	}
+
+	if err := cm.AddChallenge("b", expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if consumed, _ := cm.TryConsume("b", expireAt); consumed {
+		t.Error("TryConsume succeeded for an added challenge")
+	}
+
+	// Keys are namespaced by the prefix
+	server.mu.Lock()
+	_, prefixed := server.keys["test:a"]
+	server.mu.Unlock()
+	if !prefixed {
+		t.Error("challenge not stored under the key prefix")
+	}
+
+	// Already expired challenges still get a TTL Redis accepts
+	if err := cm.AddChallenge("c", time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatalf("AddChallenge with a past expiry: %v", err)
+	}
+}
+
+func TestRedisChallengeManagerExpiryBoundary(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cm, err := NewRedisChallengeManager(server.addr(), "", 0, "test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	// Challenges verify until the end of the second they expire in, so
+	// their keys must outlive it, even when they expire in this second
+	now := time.Now().Unix()
+	for i, expireAt := range []int64{now, now + 1, now + 30} {
+		challenge := "c" + strconv.Itoa(i)
+		if consumed, err := cm.TryConsume(challenge, expireAt); err != nil || !consumed {
+			t.Fatalf("TryConsume = %v, %v; want true", consumed, err)
+		}
+		server.mu.Lock()
+		keyExpiry := server.keys["test:"+challenge]
+		server.mu.Unlock()
+		if keyExpiry.Before(time.Unix(expireAt+1, 0)) {
+			t.Errorf("challenge expiring at %d forgotten at %v, before the end of that second", expireAt, keyExpiry)
+		}
+	}
+}
+
+func TestRedisChallengeManagerReusesConnections(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cm, err := NewRedisChallengeManager(server.addr(), "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := cm.Exists("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.connections(); got != 1 {
+		t.Fatalf("sequential commands used %d connections, want 1", got)
+	}
+
+	// A dropped idle connection is replaced transparently
+	server.dropConnections()
+	if consumed, err := cm.TryConsume("a", time.Now().Add(time.Minute).Unix()); err != nil || !consumed {
+		t.Fatalf("TryConsume after dropped connection = %v, %v; want true", consumed, err)
+	}
+	if got := server.connections(); got != 2 {
+		t.Errorf("connections after drop = %d, want 2", got)
+	}
+	if _, err := cm.Exists("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.connections(); got != 2 {
+		t.Errorf("new connection was not reused: %d connections", got)
+	}
+}
+
+func TestRedisChallengeManagerErrorReplies(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cm, err := NewRedisChallengeManager(server.addr(), "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	server.failCommand("SET", "READONLY You can't write against a read only replica.")
+	consumed, err := cm.TryConsume("a", time.Now().Add(time.Minute).Unix())
+	var redisErr redisError
+	if consumed || !errors.As(err, &redisErr) {
+		t.Fatalf("TryConsume = %v, %v; want a redis error", consumed, err)
+	}
+	if err := cm.AddChallenge("a", time.Now().Add(time.Minute).Unix()); !errors.As(err, &redisErr) {
+		t.Errorf("AddChallenge error = %v, want a redis error", err)
+	}
+
+	// Error replies leave the connection usable
+	if _, err := cm.Exists("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.connections(); got != 1 {
+		t.Errorf("error replies used %d connections, want 1", got)
+	}
+}
+
+func TestRedisChallengeManagerAuth(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+
+	if _, err := NewRedisChallengeManager(server.addr(), "wrong", 0, ""); err == nil {
+		t.Error("connected with a wrong password")
+	}
+	cm, err := NewRedisChallengeManager(server.addr(), "secret", 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	if _, err := cm.Exists("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisChallengeManagerUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if _, err := NewRedisChallengeManager(addr, "", 0, ""); err == nil {
+		t.Error("NewRedisChallengeManager succeeded without a server")
+	}
+}
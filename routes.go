@@ -1,31 +1,64 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/altcha-org/altcha-lib-go"
+	"github.com/go-chi/chi/v5"
 	"html/template"
 	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
-	"net/url"
-	"strconv"
+	"runtime"
 	"strings"
 	"time"
 )
 
+// apiRoutes returns the routes of an API version
+func (s *Server) apiRoutes(version int) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Use(s.APIVersionMiddleware(version))
+		r.With(
+			s.BodyLimitMiddleware,
+			s.challengeLimiter.RateLimitMiddleware,
+			s.APIKeyMiddleware(KeyScopeChallenge),
+			s.KeyRateLimitMiddleware,
+			s.QuotaMiddleware,
+		).Get("/challenge", s.handleGetChallenge)
+		r.With(
+			s.BodyLimitMiddleware,
+			s.verifyLimiter.RateLimitMiddleware,
+			s.APIKeyMiddleware(KeyScopeVerify),
+			s.KeyRateLimitMiddleware,
+		).Post("/challenge/verify", s.handleVerifyChallenge)
+		// Every rejection of siteverify is answered in its own format
+		r.With(
+			SiteVerifyResponsesMiddleware,
+			s.BodyLimitMiddleware,
+			s.verifyLimiter.RateLimitMiddleware,
+			s.SiteVerifyKeyMiddleware,
+			s.KeyRateLimitMiddleware,
+		).Post("/siteverify", s.handleSiteVerify)
+	}
+}
+
 // handleRoot serves the root page with server info
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
 	// Calculate total stats
 	var totalChallenges, solvedChallenges, failedChallenges int64
-	for _, stats := range s.config.Stats {
+	blockedRequests := s.access.Blocked()
+	s.stats.Range(func(_ string, stats StatsEntry) bool {
 		totalChallenges += stats.TotalChallenges
 		solvedChallenges += stats.SolvedChallenges
 		failedChallenges += stats.FailedChallenges
-	}
+		blockedRequests += stats.BlockedRequests
+		return true
+	})
 
 	// Calculate success rate
 	var successRate float64
@@ -33,6 +66,14 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		successRate = float64(solvedChallenges) / float64(totalChallenges) * 100
 	}
 
+	// Collect memory usage of per-IP tracking
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	trackedIPs := s.ipActivity.Len() + s.ipThrottle.Len() +
+		s.challengeLimiter.ipLimits.Len() + s.verifyLimiter.ipLimits.Len()
+	evictedIPs := s.ipActivity.Evicted() + s.ipThrottle.Evicted() +
+		s.challengeLimiter.ipLimits.Evicted() + s.verifyLimiter.ipLimits.Evicted()
+
 	// HTML template
 	htmlTemplate := `
 <!DOCTYPE html>
@@ -56,6 +97,12 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
         <p><strong>Solved Challenges:</strong> {{.SolvedChallenges}}</p>
         <p><strong>Failed Challenges:</strong> {{.FailedChallenges}}</p>
         <p><strong>Success Rate:</strong> {{.SuccessRate}}</p>
+        <p><strong>Blocked Requests:</strong> {{.BlockedRequests}}</p>
+    </div>
+    <div class="info">
+        <p><strong>Tracked IP Entries:</strong> {{.TrackedIPs}}</p>
+        <p><strong>Evicted IP Entries:</strong> {{.EvictedIPs}}</p>
+        <p><strong>Memory In Use:</strong> {{.MemoryInUse}}</p>
     </div>
 </body>
 </html>
@@ -67,11 +114,19 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		SolvedChallenges int64
 		FailedChallenges int64
 		SuccessRate      string
+		BlockedRequests  int64
+		TrackedIPs       int
+		EvictedIPs       int64
+		MemoryInUse      string
 	}{
 		TotalChallenges:  totalChallenges,
 		SolvedChallenges: solvedChallenges,
 		FailedChallenges: failedChallenges,
 		SuccessRate:      fmt.Sprintf("%.2f%%", successRate),
+		BlockedRequests:  blockedRequests,
+		TrackedIPs:       trackedIPs,
+		EvictedIPs:       evictedIPs,
+		MemoryInUse:      fmt.Sprintf("%.2f MB", float64(memStats.HeapAlloc)/(1024*1024)),
 	}
 
 	// Parse and execute the template
@@ -93,47 +148,59 @@ func (s *Server) handleGetChallenge(w http.ResponseWriter, r *http.Request) {
 	// Get API key from context
 	apiKey, ok := r.Context().Value(APIKeyContextKey).(string)
 	if !ok {
-		writeErrorResponse(w, "Missing API key in context", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Missing API key in context")
 		return
 	}
 
-	// Get client IP address
-	ip := GetRealIP(r)
+	// Get client IP address, grouped into its network if configured
+	clientIP := GetRealIP(r)
+	ip := s.ipKeys.Key(clientIP)
+
+	// The key's challenge settings override the global ones
+	key, _ := s.apiKey(apiKey)
+	algorithm := s.config.Algorithm
+	if key.Algorithm != "" {
+		algorithm = key.Algorithm
+	}
+	expireTime := s.config.ExpireTime
+	if key.ExpireTime != "" {
+		expireTime = key.ExpireTime
+	}
 
 	// Parse expire time from config
-	duration, err := time.ParseDuration(s.config.ExpireTime)
+	duration, err := time.ParseDuration(expireTime)
 	if err != nil {
 		duration = 5 * time.Minute // Default to 5 minutes
 	}
 
 	expires := time.Now().Add(duration)
-	complexity := s.getAdjustedComplexity(ip)
+	complexity := key.clampComplexity(s.config.Complexity)
+	if !s.allowlisted(apiKey, clientIP) {
+		complexity = key.clampComplexity(s.getAdjustedComplexity(apiKey, ip, complexity))
+	}
 
 	// Create challenge
 	challengeOptions := altcha.ChallengeOptions{
-		Algorithm: s.config.Algorithm,
-		MaxNumber: complexity,
-		HMACKey:   s.config.HMACKey,
-		Expires:   &expires,
+		Algorithm:  algorithm,
+		MaxNumber:  complexity,
+		SaltLength: key.SaltLength,
+		HMACKey:    s.config.HMACKey,
+		Expires:    &expires,
+		Params:     challengeParams(apiKey, r.Header.Get("Origin"), time.Now()),
 	}
 
 	challenge, err := altcha.CreateChallenge(challengeOptions)
 	if err != nil {
-		writeErrorResponse(w, fmt.Sprintf("Failed to create challenge: %v", err), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Failed to create challenge: %v", err))
 		return
 	}
 
 	// Update stats
-	s.mutex.Lock()
-	stats := s.config.Stats[apiKey]
-	stats.TotalChallenges++
+	s.updateStats(apiKey, func(stats *StatsEntry) {
+		stats.TotalChallenges++
+	})
 	// Track IP throttling
-	if stats.IPThrottleCount == nil {
-		stats.IPThrottleCount = make(map[string]int64)
-	}
-	stats.IPThrottleCount[ip]++
-	s.config.Stats[apiKey] = stats
-	s.mutex.Unlock()
+	s.countIPChallenge(apiKey, ip)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(challenge)
@@ -143,86 +210,214 @@ func (s *Server) handleGetChallenge(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleVerifyChallenge(w http.ResponseWriter, r *http.Request) {
 	apiKey, ok := r.Context().Value(APIKeyContextKey).(string)
 	if !ok {
-		writeErrorResponse(w, "Missing API key in context", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "Missing API key in context")
 		return
 	}
 
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeErrorResponse(w, "Failed to read request body", http.StatusBadRequest)
+	payload, remoteIP, apiErr := s.readVerifyRequest(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
 		return
 	}
-	defer r.Body.Close()
-	encodedPayload := strings.TrimSpace(string(bodyBytes))
 
-	// Decode base64 to check for replay attacks.
-	decodedBytes, err := base64.StdEncoding.DecodeString(encodedPayload)
+	// Failed and replayed verifications make the client's later challenges
+	// harder. Backends using the secret key are not the client, so they
+	// only count against an IP when they give remoteip.
+	clientIP := GetRealIP(r)
+	if secretKey, _ := r.Context().Value(SecretKeyContextKey).(bool); secretKey {
+		clientIP = remoteIP
+	}
+
+	result, err := s.verifySolution(apiKey, s.ipKeys.Key(clientIP), payload)
 	if err != nil {
-		writeErrorResponse(w, "Invalid base64 encoding", http.StatusBadRequest)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Verification error: %v", err))
 		return
 	}
+	writeVerification(w, r, result)
+}
 
-	var payload map[string]interface{}
-	if err := json.Unmarshal(decodedBytes, &payload); err != nil {
-		fmt.Printf("\nJSON unmarshal error: %v\n", err)
-		writeErrorResponse(w, "Invalid JSON payload", http.StatusBadRequest)
-		return
+// verifyRequest is the JSON body of a verification request. The solution
+// may be given as payload, or as altcha like the form field.
+type verifyRequest struct {
+	Payload  string `json:"payload"`
+	Altcha   string `json:"altcha"`
+	RemoteIP string `json:"remoteip"`
+}
+
+// readVerifyRequest reads the solution of a verification request, and the
+// client IP if given, according to its content type: a JSON object, a form
+// with the altcha field, or the base64-encoded solution on its own
+func (s *Server) readVerifyRequest(r *http.Request) (string, string, *apiError) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var payload, remoteIP string
+
+	switch mediaType {
+	case "application/json":
+		var body verifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return "", "", bodyError(err, "Invalid JSON body")
+		}
+		payload, remoteIP = body.Payload, body.RemoteIP
+		if payload == "" {
+			payload = body.Altcha
+		}
+
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", "", bodyError(err, "Failed to read request body")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if mediaType == "multipart/form-data" {
+			err = r.ParseMultipartForm(s.config.MaxBodyBytes)
+		} else {
+			err = r.ParseForm()
+		}
+		if err == nil {
+			payload, remoteIP = r.PostFormValue("altcha"), r.PostFormValue("remoteip")
+		}
+
+		// Version 1 took the bare solution whatever the content type, and
+		// many HTTP clients send bodies as forms by default
+		if payload == "" && mediaType == "application/x-www-form-urlencoded" && legacyResponses(r) {
+			payload, remoteIP, err = string(body), "", nil
+		}
+		if err != nil {
+			return "", "", bodyError(err, "Invalid form body")
+		}
+
+	default:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", "", bodyError(err, "Failed to read request body")
+		}
+		payload = string(body)
 	}
-	// Extract challenge ID and expiration
-	challengeID, ok := payload["challenge"].(string)
-	if !ok {
-		writeErrorResponse(w, "Invalid challenge format", http.StatusBadRequest)
-		return
+
+	if strings.TrimSpace(payload) == "" {
+		return "", "", &apiError{http.StatusBadRequest, CodeMalformed, "Missing payload"}
 	}
-	splitSalt := strings.Split(payload["salt"].(string), "?")
-	if len(splitSalt) <= 1 {
-		// Missing salt parameters, at least expiration is required.
-		writeErrorResponse(w, "Invalid challenge format", http.StatusBadRequest)
-		return
+	if ip := net.ParseIP(strings.TrimSpace(remoteIP)); ip != nil {
+		remoteIP = ip.String()
+	} else {
+		remoteIP = ""
 	}
-	params, _ := url.ParseQuery(splitSalt[1])
+	return payload, remoteIP, nil
+}
+
+// bodyError describes a failure to read a request body, which is either
+// too large or malformed
+func bodyError(err error, message string) *apiError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &apiError{http.StatusRequestEntityTooLarge, CodeTooLarge, "Request body too large"}
+	}
+	return &apiError{http.StatusBadRequest, CodeMalformed, message}
+}
+
+// SiteVerifyResponse is the reply of the siteverify endpoint, in the format
+// used by reCAPTCHA, hCaptcha and Turnstile
+type SiteVerifyResponse struct {
+	Success     bool     `json:"success"`
+	ChallengeTS string   `json:"challenge_ts,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	ErrorCodes  []string `json:"error-codes"`
+	Message     string   `json:"message,omitempty"` // Why the request was rejected
+}
+
+// siteVerifyErrors maps verification failures onto siteverify error codes
+var siteVerifyErrors = map[ErrorCode]string{
+	CodeMalformed:    "invalid-input-response",
+	CodeBadSignature: "invalid-input-response",
+	CodeWrongKey:     "invalid-input-response",
+	CodeExpired:      "timeout-or-duplicate",
+	CodeReplayed:     "timeout-or-duplicate",
+}
+
+// siteVerifyRejections maps the errors of rejected requests onto siteverify
+// error codes. The services Verity stands in for have no codes for rate
+// limits and blocked clients, so these get codes of their own.
+var siteVerifyRejections = map[ErrorCode]string{
+	CodeMalformed:      "bad-request",
+	CodeTooLarge:       "bad-request",
+	CodeMissingKey:     "missing-input-secret",
+	CodeInvalidKey:     "invalid-input-secret",
+	CodeKeyDisabled:    "invalid-input-secret",
+	CodeKeyExpired:     "invalid-input-secret",
+	CodeWrongScope:     "invalid-input-secret",
+	CodeOriginMismatch: "invalid-input-secret",
+	CodeIPBlocked:      "ip-blocked",
+	CodeRateLimited:    "rate-limited",
+	CodeQuotaExceeded:  "rate-limited",
+	CodeInternal:       "internal-error",
+}
+
+// SiteVerifyResponsesMiddleware makes errors of the route, including those
+// of the middleware after it, answer in the siteverify format
+func SiteVerifyResponsesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), SiteVerifyContextKey, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-	challengeExpire, err := strconv.ParseInt(params.Get("expires"), 10, 64)
-	if err != nil || challengeExpire < 1 {
-		writeErrorResponse(w, "Invalid challenge format", http.StatusBadRequest)
+// siteVerifyResponses reports whether a request gets responses in the
+// siteverify format
+func siteVerifyResponses(r *http.Request) bool {
+	siteVerify, _ := r.Context().Value(SiteVerifyContextKey).(bool)
+	return siteVerify
+}
+
+// handleSiteVerify verifies a challenge solution with the siteverify
+// protocol, so Verity can stand in for other CAPTCHA services. The solution
+// is read from the response field, and the client IP from remoteip.
+func (s *Server) handleSiteVerify(w http.ResponseWriter, r *http.Request) {
+	apiKey, ok := r.Context().Value(APIKeyContextKey).(string)
+	if !ok {
+		writeSiteVerifyResponse(w, SiteVerifyResponse{ErrorCodes: []string{"internal-error"}})
 		return
 	}
 
-	// Check for duplicate challenge
-	if cm.Exists(challengeID) {
-		writeErrorResponse(w, "Challenge already solved", http.StatusConflict)
+	response := r.FormValue("response")
+	if response == "" {
+		writeSiteVerifyResponse(w, SiteVerifyResponse{ErrorCodes: []string{"missing-input-response"}})
 		return
 	}
 
-	// Verify payload
-	verified, err := altcha.VerifySolution(encodedPayload, s.config.HMACKey, true)
+	// Count failures against the client rather than the calling backend,
+	// and against no IP when the client is not given
+	var clientIP string
+	if remoteIP := net.ParseIP(r.FormValue("remoteip")); remoteIP != nil {
+		clientIP = remoteIP.String()
+	}
+
+	result, err := s.verifySolution(apiKey, s.ipKeys.Key(clientIP), response)
 	if err != nil {
-		writeErrorResponse(w, fmt.Sprintf("Verification error: %v", err), http.StatusInternalServerError)
+		log.Printf("Verification error: %v", err)
+		writeSiteVerifyResponse(w, SiteVerifyResponse{ErrorCodes: []string{"internal-error"}})
 		return
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	reply := SiteVerifyResponse{
+		Success:    result.Error == "",
+		Hostname:   result.Hostname,
+		ErrorCodes: []string{},
+	}
+	if !result.IssuedAt.IsZero() {
+		reply.ChallengeTS = result.IssuedAt.Format(time.RFC3339)
+	}
+	if result.Error != "" {
+		reply.ErrorCodes = append(reply.ErrorCodes, siteVerifyErrors[result.Error])
+	}
+	writeSiteVerifyResponse(w, reply)
+}
 
+// writeSiteVerifyResponse writes a siteverify reply. Like the services it
+// stands in for, failures are reported with HTTP 200.
+func writeSiteVerifyResponse(w http.ResponseWriter, reply SiteVerifyResponse) {
+	if reply.ErrorCodes == nil {
+		reply.ErrorCodes = []string{}
+	}
 	w.Header().Set("Content-Type", "application/json")
-
-	if verified {
-		cm.AddChallenge(challengeID, challengeExpire)
-		stats := s.config.Stats[apiKey]
-		stats.SolvedChallenges++
-		s.config.Stats[apiKey] = stats
-		json.NewEncoder(w).Encode(Response{
-			Code:    http.StatusOK,
-			Message: "OK",
-		})
-	} else {
-		stats := s.config.Stats[apiKey]
-		stats.FailedChallenges++
-		s.config.Stats[apiKey] = stats
-		json.NewEncoder(w).Encode(Response{
-			Code:    http.StatusBadRequest,
-			Message: "Invalid payload",
-		})
-	}
-	return
+	json.NewEncoder(w).Encode(reply)
 }
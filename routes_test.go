@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/altcha-org/altcha-lib-go"
+)
+
+// BenchmarkGetChallenge measures challenge requests through the API
+// router, from many clients at once
+func BenchmarkGetChallenge(b *testing.B) {
+	s, keys := newTestServer(b, newTestMemoryStore(b), func(config *ServerConfig) {
+		config.Policies = DefaultComplexityPolicies()
+	})
+	handler := testRouter(s)
+
+	var client atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		remoteAddr := "192.0.2." + strconv.FormatInt(client.Add(1)%250, 10) + ":1234"
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("Authorization", "Bearer "+keys.SiteKey)
+			req.Header.Set("Origin", testOrigin)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				b.Fatalf("GET /challenge = %d: %s", rec.Code, rec.Body)
+			}
+		}
+	})
+}
+
+// BenchmarkVerifyChallenge measures verifications of distinct solutions
+// through the API router, from many clients at once. The solutions are
+// prepared before timing starts.
+func BenchmarkVerifyChallenge(b *testing.B) {
+	s, keys := newTestServer(b, newTestMemoryStore(b), func(config *ServerConfig) {
+		config.Complexity = 100
+	})
+	handler := testRouter(s)
+
+	solutions := make([]string, b.N)
+	for i := range solutions {
+		solutions[i] = newSolution(b, handler, keys)
+	}
+
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			solution := solutions[next.Add(1)-1]
+			req := newVerifyRequest("/api/v2/challenge/verify", "text/plain", solution, keys.SecretKey)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				b.Fatalf("POST /challenge/verify = %d: %s", rec.Code, rec.Body)
+			}
+		}
+	})
+}
+
+func TestSiteVerifyResponses(t *testing.T) {
+	const blockedIP = "198.51.100.7"
+	var legacySiteKey, limitedSecretKey string
+	s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+		config.DenyList = []string{blockedIP}
+
+		// A key from before secret keys existed, and one with a rate limit
+		legacyID, _ := GenerateKeyID()
+		legacy := NewAPIKey([]string{testOrigin})
+		legacySiteKey, _ = legacy.issue(legacyID)
+		config.APIKeys[legacyID] = legacy
+
+		limitedID, _ := GenerateKeyID()
+		limited := NewAPIKey([]string{testOrigin})
+		limited.issue(limitedID)
+		limitedSecretKey, _ = limited.issueSecretKey(limitedID)
+		limited.RateLimit, limited.Burst = "1/1h", 1
+		config.APIKeys[limitedID] = limited
+	})
+	handler := testRouter(s)
+
+	siteVerify := func(form url.Values, remoteAddr string) SiteVerifyResponse {
+		t.Helper()
+		req := newVerifyRequest("/api/v1/siteverify", "application/x-www-form-urlencoded", form.Encode(), "")
+		if remoteAddr != "" {
+			req.RemoteAddr = remoteAddr
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("siteverify = %d %s, want 200 JSON", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		var reply SiteVerifyResponse
+		if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	// Uses up the rate limit of the limited key
+	siteVerify(url.Values{"secret": {limitedSecretKey}}, "")
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		remoteAddr string
+		want       string
+	}{
+		{"valid", url.Values{"secret": {keys.SecretKey}, "response": {newSolution(t, handler, keys)}}, "", ""},
+		{"missing secret", url.Values{"response": {"x"}}, "", "missing-input-secret"},
+		{"site key", url.Values{"secret": {keys.SiteKey}, "response": {"x"}}, "", "invalid-input-secret"},
+		{"site key without secret key", url.Values{"secret": {legacySiteKey}, "response": {"x"}}, "", "invalid-input-secret"},
+		{"wrong secret", url.Values{"secret": {keys.SecretKey + "0"}, "response": {"x"}}, "", "invalid-input-secret"},
+		{"missing response", url.Values{"secret": {keys.SecretKey}}, "", "missing-input-response"},
+		{"malformed response", url.Values{"secret": {keys.SecretKey}, "response": {"x"}}, "", "invalid-input-response"},
+		{"body too large", url.Values{"secret": {keys.SecretKey}, "response": {strings.Repeat("x", DefaultMaxBody)}}, "", "bad-request"},
+		{"key rate limited", url.Values{"secret": {limitedSecretKey}, "response": {"x"}}, "", "rate-limited"},
+		{"IP blocked", url.Values{"secret": {keys.SecretKey}, "response": {"x"}}, blockedIP + ":1234", "ip-blocked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := siteVerify(tt.form, tt.remoteAddr)
+			if tt.want == "" {
+				if !reply.Success || len(reply.ErrorCodes) != 0 {
+					t.Errorf("reply = %+v, want success", reply)
+				}
+				return
+			}
+			if reply.Success || len(reply.ErrorCodes) != 1 || reply.ErrorCodes[0] != tt.want {
+				t.Errorf("reply = %+v, want error %s", reply, tt.want)
+			}
+		})
+	}
+
+	// Site keys are refused with a reason, rather than failing the origin check
+	reply := siteVerify(url.Values{"secret": {legacySiteKey}, "response": {"x"}}, "")
+	if !strings.Contains(reply.Message, secretKeyPrefix) {
+		t.Errorf("message for a site key = %q, want it to ask for a secret key", reply.Message)
+	}
+
+	// Bodies the form parser rejects are reported as such, rather than as
+	// a missing secret, even without a Content-Length to check up front
+	bodies := []struct {
+		name        string
+		body        string
+		wantMessage string
+	}{
+		{"chunked body too large", "secret=" + keys.SecretKey + "&response=" + strings.Repeat("x", DefaultMaxBody), "Request body too large"},
+		{"malformed body", "secret=" + keys.SecretKey + "&response=%zz", "Invalid form body"},
+	}
+	for _, tt := range bodies {
+		req := newVerifyRequest("/api/v1/siteverify", "application/x-www-form-urlencoded", tt.body, "")
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var reply SiteVerifyResponse
+		if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(reply.ErrorCodes) != 1 || reply.ErrorCodes[0] != "bad-request" || reply.Message != tt.wantMessage {
+			t.Errorf("%s: reply = %+v, want bad-request with %q", tt.name, reply, tt.wantMessage)
+		}
+	}
+}
+
+func TestChallengeKeySettings(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           func(key *APIKey)
+		policies      []ComplexityPolicyConfig
+		wantAlgorithm string
+		wantMax       int64
+		wantSaltBytes int
+		wantExpiry    time.Duration
+	}{
+		{"global settings", func(*APIKey) {}, nil, "SHA-256", 1000, altcha.DefaultSaltLength, 5 * time.Minute},
+		{"key overrides", func(key *APIKey) {
+			key.Algorithm, key.ExpireTime, key.SaltLength = "SHA-512", "2m", 24
+		}, nil, "SHA-512", 1000, 24, 2 * time.Minute},
+		{"raised to the key's minimum", func(key *APIKey) {
+			key.MinComplexity, key.MaxComplexity = 5000, 8000
+		}, nil, "SHA-256", 5000, altcha.DefaultSaltLength, 5 * time.Minute},
+		{"policy output above the key's maximum", func(key *APIKey) {
+			key.MinComplexity, key.MaxComplexity = 500, 8000
+		}, []ComplexityPolicyConfig{{Type: PolicyBounds, Min: 1000000}}, "SHA-256", 8000, altcha.DefaultSaltLength, 5 * time.Minute},
+		{"policy output below the key's minimum", func(key *APIKey) {
+			key.MinComplexity, key.MaxComplexity = 500, 8000
+		}, []ComplexityPolicyConfig{{Type: PolicyBounds, Max: 10}}, "SHA-256", 500, altcha.DefaultSaltLength, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+				config.Policies = tt.policies
+				for id, key := range config.APIKeys {
+					tt.key(&key)
+					config.APIKeys[id] = key
+				}
+			})
+
+			now := time.Now()
+			challenge := requestChallenge(t, testRouter(s), keys)
+			if challenge.Algorithm != tt.wantAlgorithm || challenge.MaxNumber != tt.wantMax {
+				t.Errorf("algorithm %s, maxNumber %d; want %s, %d", challenge.Algorithm, challenge.MaxNumber, tt.wantAlgorithm, tt.wantMax)
+			}
+			salt, rawParams, _ := strings.Cut(challenge.Salt, "?")
+			if len(salt) != 2*tt.wantSaltBytes {
+				t.Errorf("salt %q has %d hex digits, want %d", salt, len(salt), 2*tt.wantSaltBytes)
+			}
+			params, _ := url.ParseQuery(rawParams)
+			expires, _ := strconv.ParseInt(params.Get("expires"), 10, 64)
+			if expiry := time.Unix(expires, 0).Sub(now); expiry < tt.wantExpiry-2*time.Second || expiry > tt.wantExpiry+time.Second {
+				t.Errorf("challenge expires in %v, want %v", expiry, tt.wantExpiry)
+			}
+		})
+	}
+}
@@ -1,109 +1,379 @@
 package main
 
 import (
-	"encoding/json"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
-	"net/http"
-	"sync"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // StatsEntry holds statistics for an API key
 type StatsEntry struct {
-	TotalChallenges  int64            `json:"totalChallenges"`
-	SolvedChallenges int64            `json:"solvedChallenges"`
-	FailedChallenges int64            `json:"failedChallenges"`
-	IPThrottleCount  map[string]int64 `json:"ipThrottleCount"`
+	TotalChallenges   int64  `json:"totalChallenges"`
+	SolvedChallenges  int64  `json:"solvedChallenges"`
+	FailedChallenges  int64  `json:"failedChallenges"`
+	QuotaDay          string `json:"quotaDay"`
+	DailyChallenges   int64  `json:"dailyChallenges"`
+	QuotaMonth        string `json:"quotaMonth"`
+	MonthlyChallenges int64  `json:"monthlyChallenges"`
+	BlockedRequests   int64  `json:"blockedRequests"`
 }
 
+const (
+	// sweepInterval is how often expired per-IP entries are removed
+	sweepInterval = time.Minute
+	// statsSaveInterval is how often changed statistics, including quota
+	// use, are written to the config file
+	statsSaveInterval = time.Minute
+)
+
 // Server is the main server instance
 type Server struct {
-	config         ServerConfig
-	mutex          sync.RWMutex
-	ipRequestCount map[string]int64
-	ipLastRequest  map[string]time.Time
+	config           ServerConfig
+	ipActivity       *ShardedMap[ipActivity]
+	ipThrottle       *ShardedMap[int64]
+	ipStatsTTL       time.Duration
+	stats            *ShardedMap[StatsEntry]
+	statsChanged     atomic.Bool
+	challengeLimiter *RateLimiter
+	verifyLimiter    *RateLimiter
+	keyLimits        *ShardedMap[ipRateLimit]
+	proxies          *TrustedProxies
+	ipKeys           IPKeyer
+	access           *AccessRules
+	keyAccess        map[string]*AccessRules
+	policies         []ComplexityPolicy
+	challenges       ChallengeManager
+	configModTime    time.Time // Of the config file when lists were last read
+	done             chan struct{}
 }
 
-// Response is the standard API response format
+// ipActivity tracks recent challenge requests from an IP
+type ipActivity struct {
+	Count       int64
+	LastRequest time.Time
+}
+
+// Response is the API response format of older versions, still used by
+// version 1 of the API while legacyV1Responses is set
 type Response struct {
 	Code    int    `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 }
 
 // NewServer creates a new server instance
-func NewServer(config ServerConfig) *Server {
-	return &Server{
-		config:         config,
-		mutex:          sync.RWMutex{},
-		ipRequestCount: make(map[string]int64),
-		ipLastRequest:  make(map[string]time.Time),
+func NewServer(config ServerConfig, challenges ChallengeManager) *Server {
+	ipStatsTTL, err := time.ParseDuration(config.IPStatsTTL)
+	if err != nil {
+		ipStatsTTL = 24 * time.Hour // Default to a day
+	}
+	challengeRate, err := ParseRate(config.ChallengeRate)
+	if err != nil {
+		challengeRate, _ = ParseRate(DefaultRateLimit)
+	}
+	verifyRate, err := ParseRate(config.VerifyRate)
+	if err != nil {
+		verifyRate, _ = ParseRate(DefaultRateLimit)
+	}
+	proxies, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		proxies = &TrustedProxies{} // Trust no one
+	}
+
+	ipKeys := IPKeyer{IPv4Bits: config.IPv4Prefix, IPv6Bits: config.IPv6Prefix}
+	access, err := NewAccessRules(config.AllowList, config.AllowListFile, config.DenyList, config.DenyListFile)
+	if err != nil {
+		log.Printf("Ignoring access lists: %v", err)
+		access = nil
+	}
+	keyAccess := make(map[string]*AccessRules)
+	var withoutSecretKey []string
+	for apiKey, key := range config.APIKeys {
+		if !key.hasSecretKey() {
+			withoutSecretKey = append(withoutSecretKey, apiKey)
+		}
+		rules, err := key.accessRules()
+		if err != nil {
+			log.Printf("Ignoring access lists of API key %s: %v", apiKey, err)
+			continue
+		}
+		keyAccess[apiKey] = rules
+	}
+	if len(withoutSecretKey) > 0 {
+		sort.Strings(withoutSecretKey)
+		log.Printf("Warning: API keys without a secret key can verify with their public site key: %s. Issue secret keys with 'verity keys rotate-secret <id>'.",
+			strings.Join(withoutSecretKey, ", "))
+	}
+
+	s := &Server{
+		config:           config,
+		ipActivity:       NewShardedMap[ipActivity](config.MaxIPs),
+		ipThrottle:       NewShardedMap[int64](config.MaxIPs),
+		ipStatsTTL:       ipStatsTTL,
+		stats:            NewShardedMap[StatsEntry](0),
+		challengeLimiter: NewRateLimiter(challengeRate, config.ChallengeBurst, config.MaxIPs, ipKeys, access),
+		verifyLimiter:    NewRateLimiter(verifyRate, config.VerifyBurst, config.MaxIPs, ipKeys, access),
+		keyLimits:        NewShardedMap[ipRateLimit](0),
+		proxies:          proxies,
+		ipKeys:           ipKeys,
+		access:           access,
+		keyAccess:        keyAccess,
+		challenges:       challenges,
+		done:             make(chan struct{}),
+	}
+
+	for apiKey, stats := range config.Stats {
+		s.stats.Set(apiKey, stats, time.Time{})
+	}
+
+	s.policies, err = NewComplexityPolicies(config.Policies, s.ipActivity, config.MaxIPs)
+	if err != nil {
+		log.Printf("Using default complexity policies: %v", err)
+		s.policies, _ = NewComplexityPolicies(DefaultComplexityPolicies(), s.ipActivity, config.MaxIPs)
+	}
+
+	go s.sweepLoop()
+	go s.reloadLoop()
+	if config.Path != "" {
+		go s.saveLoop()
+	}
+	return s
+}
+
+// Close stops the background cleanup of per-IP state
+func (s *Server) Close() {
+	close(s.done)
+}
+
+// apiKey returns the settings of an API key. Keys are read once at startup
+// and never change while running, so no lock is needed.
+func (s *Server) apiKey(apiKey string) (APIKey, bool) {
+	key, exists := s.config.APIKeys[apiKey]
+	return key, exists
+}
+
+// Stats returns a copy of the statistics of all API keys
+func (s *Server) Stats() map[string]StatsEntry {
+	snapshot := make(map[string]StatsEntry)
+	s.stats.Range(func(apiKey string, stats StatsEntry) bool {
+		snapshot[apiKey] = stats
+		return true
+	})
+	return snapshot
+}
+
+// SaveStats writes the statistics to the config file. Only the stats are
+// merged into it, as API keys may have been changed with 'verity keys'
+// meanwhile.
+func (s *Server) SaveStats() error {
+	stats := s.Stats()
+	return UpdateConfig(s.config.Path, func(saved *ServerConfig) error {
+		saved.Stats = make(map[string]StatsEntry)
+		for apiKey, entry := range stats {
+			if _, exists := saved.APIKeys[apiKey]; exists {
+				saved.Stats[apiKey] = entry
+			}
+		}
+		return nil
+	})
+}
+
+// saveLoop periodically saves changed statistics, so quota use survives
+// a crash
+func (s *Server) saveLoop() {
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !s.statsChanged.Swap(false) {
+				continue
+			}
+			if err := s.SaveStats(); err != nil {
+				log.Printf("Error saving stats: %v", err)
+				s.statsChanged.Store(true)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// countIPChallenge counts a challenge issued to an IP for an API key. The
+// counts are kept in memory only, and forgotten after ipStatsTTL.
+func (s *Server) countIPChallenge(apiKey, ip string) {
+	expireAt := time.Now().Add(s.ipStatsTTL)
+	s.ipThrottle.Update(ipThrottleKey(apiKey, ip), func(count int64, _ bool) (int64, time.Time) {
+		return count + 1, expireAt
+	})
+}
+
+// ipThrottleKey returns the key of an API key and IP pair in ipThrottle
+func ipThrottleKey(apiKey, ip string) string {
+	return apiKey + "|" + ip
+}
+
+// sweepLoop periodically removes expired per-IP entries
+func (s *Server) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.ipActivity.Sweep(now)
+			s.ipThrottle.Sweep(now)
+			s.challengeLimiter.ipLimits.Sweep(now)
+			s.verifyLimiter.ipLimits.Sweep(now)
+			s.keyLimits.Sweep(now)
+			for _, policy := range s.policies {
+				if policy, ok := policy.(sweeper); ok {
+					policy.Sweep(now)
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reloadLoop periodically picks up changes to the IP list files
+func (s *Server) reloadLoop() {
+	ticker := time.NewTicker(accessReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.access.Reload()
+			for _, rules := range s.keyAccess {
+				rules.Reload()
+			}
+			s.reloadInlineLists()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reloadInlineLists applies changes to the inline allowlists and denylists
+// in the config file, globally and of each API key. Other settings, and
+// keys added since startup, still take a restart.
+func (s *Server) reloadInlineLists() {
+	if s.config.Path == "" {
+		return
+	}
+	info, err := os.Stat(s.config.Path)
+	if err != nil || info.ModTime().Equal(s.configModTime) {
+		return
+	}
+	s.configModTime = info.ModTime()
+	config, err := readServerConfig(s.config.Path)
+	if err != nil {
+		log.Printf("Error reloading IP lists: %v", err)
+		return
+	}
+
+	if changed, err := s.access.SetInline(config.AllowList, config.DenyList); err != nil {
+		log.Printf("Error reloading IP lists: %v", err)
+	} else if changed {
+		log.Printf("Reloaded the inline IP lists.")
+	}
+	for apiKey, rules := range s.keyAccess {
+		// Revoked keys keep working until a restart, and keep their lists
+		key, exists := config.APIKeys[apiKey]
+		if !exists {
+			continue
+		}
+		if changed, err := rules.SetInline(key.AllowList, key.DenyList); err != nil {
+			log.Printf("Error reloading IP lists of API key %s: %v", apiKey, err)
+		} else if changed {
+			log.Printf("Reloaded the inline IP lists of API key %s.", apiKey)
+		}
 	}
 }
 
+// allowlisted reports whether an IP is exempt from rate limits and
+// complexity escalation, globally or for an API key
+func (s *Server) allowlisted(apiKey, ip string) bool {
+	return s.access.Check(ip) == AccessAllowed || s.keyAccess[apiKey].Check(ip) == AccessAllowed
+}
+
+// updateStats applies fn to the statistics of an API key
+func (s *Server) updateStats(apiKey string, fn func(stats *StatsEntry)) {
+	s.statsChanged.Store(true)
+	s.stats.Update(apiKey, func(stats StatsEntry, _ bool) (StatsEntry, time.Time) {
+		fn(&stats)
+		return stats, time.Time{}
+	})
+}
+
 // setupRouter configures the HTTP router
 func (s *Server) setupRouter() *chi.Mux {
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.RealIP)
+	r.Use(s.proxies.RealIPMiddleware)
 	r.Use(middleware.RequestID)
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"}, // We'll check origins in our handler
+		AllowedOrigins:   []string{"*"}, // We'll validate in our middleware
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Verity-Key"},
+		ExposedHeaders:   []string{"Link", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
+	r.Use(RedactAPIKeyMiddleware)
+	r.Use(middleware.Logger)
 
-	// Routes
-	r.Get("/", s.handleRoot)
-	r.Route("/api/v1", func(r chi.Router) {
-		r.Get("/challenge", s.handleGetChallenge)
-		r.Post("/challenge/verify", s.handleVerifyChallenge)
-	})
+	// Public routes, sharing the challenge rate limit. Their errors keep the
+	// format of version 1.
+	r.With(s.APIVersionMiddleware(1), s.challengeLimiter.RateLimitMiddleware).Get("/", s.handleRoot)
 
-	return r
-}
+	// API routes with rate limits and key validation. The versions only
+	// differ in the format of their responses.
+	r.Route("/api/v1", s.apiRoutes(1))
+	r.Route("/api/v2", s.apiRoutes(2))
 
-// writeErrorResponse writes an error response to the client
-func writeErrorResponse(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(Response{Code: 400, Message: message})
+	return r
 }
 
-// getAdjustedComplexity returns the complexity adjusted for server load
-func (s *Server) getAdjustedComplexity(ip string) int64 {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Check if the IP has made requests recently
-	count, exists := s.ipRequestCount[ip]
-	lastTime, timeExists := s.ipLastRequest[ip]
+// getAdjustedComplexity returns the complexity for a challenge, as adjusted
+// from the base complexity by the complexity policies
+func (s *Server) getAdjustedComplexity(apiKey, ip string, complexity int64) int64 {
+	req := ComplexityRequest{APIKey: apiKey, IP: ip, Now: time.Now()}
 
-	// Reset counter if the last request was more than 5 minutes ago
-	if timeExists && time.Since(lastTime) > 5*time.Minute {
-		count = 0
+	for _, policy := range s.policies {
+		complexity = policy.Adjust(req, complexity)
 	}
 
-	// Update request count and time
-	s.ipRequestCount[ip] = count + 1
-	s.ipLastRequest[ip] = time.Now()
-
-	// Base complexity
-	complexity := s.config.Complexity
+	return complexity
+}
 
-	// Adjust complexity based on request frequency
-	if exists && count > 10 {
-		// Increase complexity by 10% for each 10 requests
-		factor := 1.0 + float64(count/10)*0.1
-		return int64(float64(complexity) * factor)
+// recordFailure reports a failed or replayed verification to the complexity
+// policies, so later challenges for the IP or API key get harder
+func (s *Server) recordFailure(apiKey, ip string) {
+	req := ComplexityRequest{APIKey: apiKey, IP: ip, Now: time.Now()}
+	for _, policy := range s.policies {
+		if observer, ok := policy.(FailureObserver); ok {
+			observer.ObserveFailure(req)
+		}
 	}
+}
 
-	return complexity
+// recordSuccess reports a successful verification to the complexity policies
+func (s *Server) recordSuccess(apiKey, ip string) {
+	req := ComplexityRequest{APIKey: apiKey, IP: ip, Now: time.Now()}
+	for _, policy := range s.policies {
+		if observer, ok := policy.(SuccessObserver); ok {
+			observer.ObserveSuccess(req)
+		}
+	}
 }
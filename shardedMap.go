@@ -0,0 +1,286 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// mapShardCount is the number of independently locked shards in a ShardedMap
+const mapShardCount = 64
+
+// ShardedMap is a concurrent map with string keys, split over independently
+// locked shards to reduce lock contention. Entries may carry an expiry time.
+// Expired entries are treated as absent, and Sweep removes them using a
+// per-shard min-heap, so it only touches entries that have expired. A map
+// with a capacity evicts its least recently used entries once full.
+type ShardedMap[V any] struct {
+	shards [mapShardCount]mapShard[V]
+}
+
+// mapShard holds part of the entries of a ShardedMap
+type mapShard[V any] struct {
+	mu       sync.Mutex
+	items    map[string]*mapEntry[V]
+	expiry   entryHeap[V]
+	lru      *list.List // Most recently used entries first, nil if unbounded
+	capacity int
+	evicted  int64
+}
+
+// mapEntry is a value with an optional expiry time
+type mapEntry[V any] struct {
+	key      string
+	value    V
+	expireAt time.Time
+	index    int // Position in the expiry heap, or -1 if it never expires
+	lruElem  *list.Element
+}
+
+// NewShardedMap creates an empty sharded map holding at most capacity
+// entries. A capacity of 0 means the map is unbounded.
+func NewShardedMap[V any](capacity int) *ShardedMap[V] {
+	m := &ShardedMap[V]{}
+	for i := range m.shards {
+		m.shards[i].items = make(map[string]*mapEntry[V])
+		if capacity > 0 {
+			// Round up, so every shard can hold at least one entry
+			m.shards[i].capacity = (capacity + mapShardCount - 1) / mapShardCount
+			m.shards[i].lru = list.New()
+		}
+	}
+	return m
+}
+
+// Get returns the value stored for key
+func (m *ShardedMap[V]) Get(key string) (V, bool) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.lookup(key, time.Now())
+	if entry == nil {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores value for key until expireAt. A zero expireAt never expires.
+func (m *ShardedMap[V]) Set(key string, value V, expireAt time.Time) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.store(key, value, expireAt, shard.lookup(key, time.Now()))
+}
+
+// SetIfAbsent stores value for key unless the key is already present, and
+// reports whether it was stored
+func (m *ShardedMap[V]) SetIfAbsent(key string, value V, expireAt time.Time) bool {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.lookup(key, time.Now()) != nil {
+		return false
+	}
+	shard.store(key, value, expireAt, nil)
+	return true
+}
+
+// Update calls fn with the current value for key while holding the shard
+// lock, and stores the value and expiry fn returns. fn must not call methods
+// on the map.
+func (m *ShardedMap[V]) Update(key string, fn func(value V, exists bool) (V, time.Time)) V {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var value V
+	entry := shard.lookup(key, time.Now())
+	if entry != nil {
+		value = entry.value
+	}
+	value, expireAt := fn(value, entry != nil)
+	shard.store(key, value, expireAt, entry)
+	return value
+}
+
+// Delete removes key from the map
+func (m *ShardedMap[V]) Delete(key string) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if entry, ok := shard.items[key]; ok {
+		shard.remove(entry)
+	}
+}
+
+// Len returns the number of entries, including expired ones that have not
+// been swept yet
+func (m *ShardedMap[V]) Len() int {
+	total := 0
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		total += len(shard.items)
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// Evicted returns the number of entries evicted to stay within capacity
+func (m *ShardedMap[V]) Evicted() int64 {
+	var total int64
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		total += shard.evicted
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// Range calls fn for every unexpired entry until fn returns false. Shards are
+// locked one at a time, and fn must not call methods on the map.
+func (m *ShardedMap[V]) Range(fn func(key string, value V) bool) {
+	now := time.Now()
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		for key, entry := range shard.items {
+			if entry.expired(now) {
+				continue
+			}
+			if !fn(key, entry.value) {
+				shard.mu.Unlock()
+				return
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Sweep removes all entries that expired by now and returns how many were
+// removed
+func (m *ShardedMap[V]) Sweep(now time.Time) int {
+	removed := 0
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		for len(shard.expiry) > 0 && shard.expiry[0].expired(now) {
+			shard.remove(shard.expiry[0])
+			removed++
+		}
+		shard.mu.Unlock()
+	}
+	return removed
+}
+
+// shard returns the shard responsible for key
+func (m *ShardedMap[V]) shard(key string) *mapShard[V] {
+	return &m.shards[fnv32a(key)%mapShardCount]
+}
+
+// lookup returns the entry for key, removing it if it has expired, and marks
+// it as recently used. The caller must hold shard.mu.
+func (shard *mapShard[V]) lookup(key string, now time.Time) *mapEntry[V] {
+	entry, ok := shard.items[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(now) {
+		shard.remove(entry)
+		return nil
+	}
+	if entry.lruElem != nil {
+		shard.lru.MoveToFront(entry.lruElem)
+	}
+	return entry
+}
+
+// store saves a value in entry, or in a new entry if entry is nil. The
+// caller must hold shard.mu.
+func (shard *mapShard[V]) store(key string, value V, expireAt time.Time, entry *mapEntry[V]) {
+	if entry == nil {
+		if shard.lru != nil && len(shard.items) >= shard.capacity {
+			shard.remove(shard.lru.Back().Value.(*mapEntry[V]))
+			shard.evicted++
+		}
+		entry = &mapEntry[V]{key: key, index: -1}
+		shard.items[key] = entry
+		if shard.lru != nil {
+			entry.lruElem = shard.lru.PushFront(entry)
+		}
+	}
+	entry.value = value
+	entry.expireAt = expireAt
+
+	switch {
+	case expireAt.IsZero() && entry.index >= 0:
+		heap.Remove(&shard.expiry, entry.index)
+	case expireAt.IsZero():
+	case entry.index >= 0:
+		heap.Fix(&shard.expiry, entry.index)
+	default:
+		heap.Push(&shard.expiry, entry)
+	}
+}
+
+// remove deletes an entry. The caller must hold shard.mu.
+func (shard *mapShard[V]) remove(entry *mapEntry[V]) {
+	delete(shard.items, entry.key)
+	if entry.index >= 0 {
+		heap.Remove(&shard.expiry, entry.index)
+	}
+	if entry.lruElem != nil {
+		shard.lru.Remove(entry.lruElem)
+		entry.lruElem = nil
+	}
+}
+
+// expired reports whether the entry has expired by now
+func (entry *mapEntry[V]) expired(now time.Time) bool {
+	return !entry.expireAt.IsZero() && !now.Before(entry.expireAt)
+}
+
+// entryHeap is a min-heap of entries ordered by expiry time
+type entryHeap[V any] []*mapEntry[V]
+
+func (h entryHeap[V]) Len() int           { return len(h) }
+func (h entryHeap[V]) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+
+func (h entryHeap[V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap[V]) Push(x any) {
+	entry := x.(*mapEntry[V])
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *entryHeap[V]) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// fnv32a returns the 32-bit FNV-1a hash of a string
+func fnv32a(s string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+	return hash
+}
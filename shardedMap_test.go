@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedMapGetSet(t *testing.T) {
+	m := NewShardedMap[int](0)
+	now := time.Now()
+
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("Get found a key in an empty map")
+	}
+	m.Set("a", 1, time.Time{})
+	m.Set("b", 2, now.Add(time.Hour))
+	m.Set("c", 3, now.Add(-time.Second))
+
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Errorf("Get(a) = %d, %v; want 1, true", v, ok)
+	}
+	if v, ok := m.Get("b"); !ok || v != 2 {
+		t.Errorf("Get(b) = %d, %v; want 2, true", v, ok)
+	}
+	if _, ok := m.Get("c"); ok {
+		t.Error("Get returned an expired entry")
+	}
+
+	m.Set("a", 10, time.Time{})
+	if v, _ := m.Get("a"); v != 10 {
+		t.Errorf("Get(a) after overwrite = %d, want 10", v)
+	}
+	m.Delete("a")
+	if _, ok := m.Get("a"); ok {
+		t.Error("Get found a deleted key")
+	}
+}
+
+func TestShardedMapSetIfAbsent(t *testing.T) {
+	m := NewShardedMap[string](0)
+	now := time.Now()
+
+	if !m.SetIfAbsent("a", "first", now.Add(time.Hour)) {
+		t.Fatal("SetIfAbsent refused an absent key")
+	}
+	if m.SetIfAbsent("a", "second", now.Add(time.Hour)) {
+		t.Fatal("SetIfAbsent replaced a present key")
+	}
+	if v, _ := m.Get("a"); v != "first" {
+		t.Errorf("Get(a) = %q, want first", v)
+	}
+
+	// Expired entries count as absent
+	m.Set("b", "old", now.Add(-time.Second))
+	if !m.SetIfAbsent("b", "new", now.Add(time.Hour)) {
+		t.Error("SetIfAbsent refused a key whose entry expired")
+	}
+}
+
+func TestShardedMapSetIfAbsentConcurrent(t *testing.T) {
+	m := NewShardedMap[int](0)
+	const workers = 64
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if m.SetIfAbsent("key", i, time.Time{}) {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Fatalf("%d SetIfAbsent calls succeeded, want 1", won)
+	}
+}
+
+func TestShardedMapUpdate(t *testing.T) {
+	m := NewShardedMap[int](0)
+	now := time.Now()
+
+	increment := func(v int, exists bool) (int, time.Time) {
+		if !exists && v != 0 {
+			t.Errorf("Update passed %d for an absent key", v)
+		}
+		return v + 1, now.Add(time.Hour)
+	}
+	if v := m.Update("a", increment); v != 1 {
+		t.Errorf("first Update = %d, want 1", v)
+	}
+	if v := m.Update("a", increment); v != 2 {
+		t.Errorf("second Update = %d, want 2", v)
+	}
+
+	// An expired entry starts over from the zero value
+	m.Set("b", 5, now.Add(-time.Second))
+	m.Update("b", func(v int, exists bool) (int, time.Time) {
+		if exists || v != 0 {
+			t.Errorf("Update saw expired entry: %d, %v", v, exists)
+		}
+		return 1, time.Time{}
+	})
+
+	// Update may shorten or remove an expiry
+	m.Update("a", func(v int, _ bool) (int, time.Time) { return v, now.Add(-time.Second) })
+	if _, ok := m.Get("a"); ok {
+		t.Error("entry still present after Update expired it")
+	}
+	m.Set("c", 1, now.Add(-time.Second))
+	m.Set("c", 1, time.Time{})
+	if removed := m.Sweep(now.Add(time.Hour)); removed != 0 {
+		t.Errorf("Sweep removed %d entries that no longer expire", removed)
+	}
+}
+
+func TestShardedMapSweep(t *testing.T) {
+	m := NewShardedMap[int](0)
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		expireAt := now.Add(time.Duration(i) * time.Second)
+		if i%2 == 0 {
+			expireAt = time.Time{}
+		}
+		m.Set(strconv.Itoa(i), i, expireAt)
+	}
+
+	// Entries expire at their expiry time, so those at or before now+99s go
+	if removed := m.Sweep(now.Add(99 * time.Second)); removed != 50 {
+		t.Errorf("Sweep removed %d entries, want 50", removed)
+	}
+	if got := m.Len(); got != 950 {
+		t.Errorf("Len after sweep = %d, want 950", got)
+	}
+	if removed := m.Sweep(now.Add(99 * time.Second)); removed != 0 {
+		t.Errorf("second Sweep removed %d entries, want 0", removed)
+	}
+	if removed := m.Sweep(now.Add(time.Hour)); removed != 450 {
+		t.Errorf("final Sweep removed %d entries, want 450", removed)
+	}
+
+	count := 0
+	m.Range(func(key string, value int) bool {
+		if value%2 != 0 {
+			t.Errorf("Range returned expiring entry %s", key)
+		}
+		count++
+		return true
+	})
+	if count != 500 {
+		t.Errorf("Range visited %d entries, want 500", count)
+	}
+}
+
+func TestShardedMapRangeSkipsExpired(t *testing.T) {
+	m := NewShardedMap[int](0)
+	m.Set("live", 1, time.Time{})
+	m.Set("expired", 2, time.Now().Add(-time.Second))
+
+	var keys []string
+	m.Range(func(key string, _ int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "live" {
+		t.Errorf("Range visited %v, want [live]", keys)
+	}
+}
+
+func TestShardedMapCapacity(t *testing.T) {
+	// One entry per shard, so every new key in a full shard evicts
+	m := NewShardedMap[int](mapShardCount)
+	shardKeys := keysInShard(m, 3)
+
+	m.Set(shardKeys[0], 0, time.Time{})
+	m.Set(shardKeys[1], 1, time.Time{})
+	if _, ok := m.Get(shardKeys[0]); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := m.Get(shardKeys[1]); !ok {
+		t.Error("newest entry was evicted")
+	}
+	if got := m.Evicted(); got != 1 {
+		t.Errorf("Evicted = %d, want 1", got)
+	}
+
+	// Capacities round up, and Get marks entries as recently used
+	m = NewShardedMap[int](2 * mapShardCount)
+	m.Set(shardKeys[0], 0, time.Time{})
+	m.Set(shardKeys[1], 1, time.Time{})
+	m.Get(shardKeys[0])
+	m.Set(shardKeys[2], 2, time.Time{})
+	if _, ok := m.Get(shardKeys[0]); !ok {
+		t.Error("recently read entry was evicted")
+	}
+	if _, ok := m.Get(shardKeys[1]); ok {
+		t.Error("least recently used entry was kept")
+	}
+}
+
+// keysInShard returns n keys that map to the same shard of m
+func keysInShard[V any](m *ShardedMap[V], n int) []string {
+	target := m.shard("0")
+	keys := []string{"0"}
+	for i := 1; len(keys) < n; i++ {
+		if key := strconv.Itoa(i); m.shard(key) == target {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -3,84 +3,84 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
 	"fmt"
-	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 )
 
-// ipRateLimit stores rate limiting information for an IP
+// ipRateLimit stores rate limiting information for an IP. ResetAt is the
+// theoretical arrival time of GCRA, when the IP's bucket is full again.
 type ipRateLimit struct {
-	Count   int
 	ResetAt time.Time
 }
 
-// GenerateAPIKey generates a new API key with the vrty_ prefix
-func GenerateAPIKey() (string, error) {
-	bytes := make([]byte, 16)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return "vrty_" + hex.EncodeToString(bytes), nil
-}
-
-// GetRealIP attempts to get the client's real IP address
+// GetRealIP returns the client IP resolved by TrustedProxies.RealIPMiddleware,
+// falling back to the immediate peer
 func GetRealIP(r *http.Request) string {
-	// Check for X-Forwarded-For first
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(ip, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Check X-Real-IP
-	ip = r.Header.Get("X-Real-IP")
-	if ip != "" {
+	if ip, ok := r.Context().Value(ClientIPContextKey).(string); ok {
 		return ip
 	}
+	return remoteIP(r)
+}
 
-	// Extract from RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// If there's an error, just return the RemoteAddr
-		return r.RemoteAddr
-	}
-	return ip
+// RateLimitResult describes a rate limit after a request
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int           // Maximum burst size
+	Remaining  int           // Requests that may be sent right away
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until the next request is allowed, if rejected
 }
 
-// LimitByIP implements rate limiting by IP address
-func LimitByIP(ip string, limit int, window time.Duration, store map[string]*ipRateLimit) bool {
+// LimitByIP implements rate limiting by IP address with the generic cell
+// rate algorithm. Requests are allowed at the steady rate, plus bursts of up
+// to burst requests. Entries expire once the IP's bucket is full again.
+func LimitByIP(ip string, rate Rate, burst int, store *ShardedMap[ipRateLimit]) RateLimitResult {
 	now := time.Now()
+	interval := rate.interval()
+	window := time.Duration(burst) * interval
+	result := RateLimitResult{Limit: burst}
 
-	// Create or get rate limit info for this IP
-	info, exists := store[ip]
-	if !exists {
-		info = &ipRateLimit{
-			Count:   0,
-			ResetAt: now.Add(window),
+	store.Update(ip, func(info ipRateLimit, exists bool) (ipRateLimit, time.Time) {
+		// Unknown IPs and expired entries start with a full bucket
+		resetAt := info.ResetAt
+		if !exists || resetAt.Before(now) {
+			resetAt = now
 		}
-		store[ip] = info
-	}
+		next := resetAt.Add(interval)
 
-	// Check if we need to reset the counter
-	if now.After(info.ResetAt) {
-		info.Count = 0
-		info.ResetAt = now.Add(window)
-	}
+		// Reject the request if it would overflow the bucket
+		if next.Sub(now) > window {
+			result.RetryAfter = next.Sub(now) - window
+		} else {
+			resetAt = next
+			info.ResetAt = resetAt
+			result.Allowed = true
+		}
 
-	// Check if we're over the limit
-	if info.Count >= limit {
-		return false
+		result.Reset = resetAt.Sub(now)
+		result.Remaining = int((window - result.Reset) / interval)
+		return info, info.ResetAt
+	})
+
+	return result
+}
+
+// setRateLimitHeaders writes the RateLimit header fields of a result, and
+// Retry-After if the request was rejected
+func setRateLimitHeaders(w http.ResponseWriter, result RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(result.Reset), 10))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(result.RetryAfter), 10))
 	}
+}
 
-	// Increment the counter
-	info.Count++
-	return true
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
 }
 
 // GenerateHMACKey generates a 32-byte secure HMAC key.
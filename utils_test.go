@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// elapse moves the rate limit state of key d into the past, as if d had
+// passed since its requests
+func elapse(store *ShardedMap[ipRateLimit], key string, d time.Duration) {
+	info, _ := store.Get(key)
+	info.ResetAt = info.ResetAt.Add(-d)
+	store.Set(key, info, info.ResetAt)
+}
+
+func TestLimitByIP(t *testing.T) {
+	rate := Rate{Requests: 1, Period: time.Hour}
+	store := NewShardedMap[ipRateLimit](0)
+
+	// A new IP gets the whole burst right away
+	for i := range 3 {
+		result := LimitByIP("a", rate, 3, store)
+		if !result.Allowed || result.Remaining != 2-i || result.Limit != 3 {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i+1, result, 2-i)
+		}
+	}
+	result := LimitByIP("a", rate, 3, store)
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("request over the burst = %+v, want rejected", result)
+	}
+	if result.RetryAfter <= 59*time.Minute || result.RetryAfter > time.Hour {
+		t.Errorf("RetryAfter = %v, want an hour", result.RetryAfter)
+	}
+	if result.Reset <= 179*time.Minute || result.Reset > 3*time.Hour {
+		t.Errorf("Reset = %v, want three hours", result.Reset)
+	}
+
+	// Other IPs have their own bucket
+	if result := LimitByIP("b", rate, 3, store); !result.Allowed {
+		t.Error("another IP was limited")
+	}
+
+	// Afterwards one request is allowed per interval
+	for range 3 {
+		elapse(store, "a", time.Hour)
+		if result := LimitByIP("a", rate, 3, store); !result.Allowed {
+			t.Fatal("request after an interval rejected")
+		}
+		if result := LimitByIP("a", rate, 3, store); result.Allowed {
+			t.Fatal("second request within an interval allowed")
+		}
+	}
+
+	// Once the bucket is full again, its state is dropped
+	if removed := store.Sweep(time.Now().Add(3*time.Hour + time.Second)); removed != 2 || store.Len() != 0 {
+		t.Errorf("sweep removed %d entries, %d left; want all of them", removed, store.Len())
+	}
+	if result := LimitByIP("a", rate, 3, store); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("request after the window = %+v, want a full bucket", result)
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     RateLimitResult
+		want       map[string]string
+		retryAfter bool
+	}{
+		{"allowed", RateLimitResult{Allowed: true, Limit: 10, Remaining: 9, Reset: 1500 * time.Millisecond},
+			map[string]string{"RateLimit-Limit": "10", "RateLimit-Remaining": "9", "RateLimit-Reset": "2"}, false},
+		{"rejected", RateLimitResult{Limit: 10, Reset: time.Minute, RetryAfter: 5100 * time.Millisecond},
+			map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "60", "Retry-After": "6"}, true},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		setRateLimitHeaders(rec, tt.result)
+		for name, want := range tt.want {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, want)
+			}
+		}
+		if _, set := rec.Header()["Retry-After"]; set != tt.retryAfter {
+			t.Errorf("%s: Retry-After set = %v, want %v", tt.name, set, tt.retryAfter)
+		}
+	}
+}
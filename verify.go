@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/altcha-org/altcha-lib-go"
+)
+
+// Salt parameters recorded in challenges along with their expiry time.
+// They are covered by the challenge signature.
+const (
+	paramIssued = "issued"
+	paramHost   = "host"
+	paramKey    = "key"
+)
+
+// Verification is the outcome of verifying a solution
+type Verification struct {
+	Error    ErrorCode // Empty if the solution is valid
+	Message  string    // Describes Error
+	IssuedAt time.Time // Zero if unknown or the signature is invalid
+	Hostname string    // Site the challenge was requested from, if known
+}
+
+// challengeParams returns the salt parameters of a new challenge for
+// apiKey, requested from origin
+func challengeParams(apiKey, origin string, now time.Time) url.Values {
+	params := url.Values{}
+	params.Set(paramIssued, strconv.FormatInt(now.Unix(), 10))
+	params.Set(paramKey, apiKey)
+	if u, err := url.Parse(origin); err == nil && u.Hostname() != "" {
+		params.Set(paramHost, u.Hostname())
+	}
+	return params
+}
+
+// decodePayload decodes a base64-encoded solution and the parameters of its
+// salt, or describes why it can't
+func decodePayload(encoded string) (altcha.Payload, url.Values, string) {
+	var payload altcha.Payload
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return payload, nil, "Invalid base64 encoding"
+	}
+	if err := json.Unmarshal(decoded, &payload); err != nil {
+		return payload, nil, "Invalid JSON payload"
+	}
+
+	// At least the expiry time is required in the salt parameters
+	_, rawParams, found := strings.Cut(payload.Salt, "?")
+	if payload.Challenge == "" || !found {
+		return payload, nil, "Invalid challenge format"
+	}
+	params, err := url.ParseQuery(rawParams)
+	if err != nil {
+		return payload, nil, "Invalid challenge format"
+	}
+	return payload, params, ""
+}
+
+// verifySolution verifies a base64-encoded solution for apiKey and marks it
+// as solved. Failed and replayed verifications are counted against the key
+// and ip, which should be grouped with ipKeys and is empty if the client is
+// unknown. The error is only set if the solution couldn't be checked.
+func (s *Server) verifySolution(apiKey, ip, encoded string) (Verification, error) {
+	payload, params, message := decodePayload(encoded)
+	if message != "" {
+		return Verification{Error: CodeMalformed, Message: message}, nil
+	}
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil || expires < 1 {
+		return Verification{Error: CodeMalformed, Message: "Invalid challenge format"}, nil
+	}
+
+	var result Verification
+
+	// The replay store is only consulted once the signature is checked, so
+	// forged payloads can't probe it. Errors only come from payload fields,
+	// such as an unknown algorithm.
+	verified, err := altcha.VerifySolution(payload, s.config.HMACKey, false)
+	if err != nil {
+		result.Error, result.Message = CodeMalformed, "Invalid challenge format"
+		return result, nil
+	}
+	if verified {
+		// The parameters can be trusted now that the signature is checked
+		result.Hostname = params.Get(paramHost)
+		if issued, err := strconv.ParseInt(params.Get(paramIssued), 10, 64); err == nil {
+			result.IssuedAt = time.Unix(issued, 0).UTC()
+		}
+	}
+	switch {
+	case !verified:
+		result.Error, result.Message = CodeBadSignature, "Invalid payload"
+	case time.Now().Unix() > expires:
+		result.Error, result.Message = CodeExpired, "Challenge expired"
+	case params.Has(paramKey) && params.Get(paramKey) != apiKey:
+		// Challenges issued before keys were recorded are accepted
+		result.Error, result.Message = CodeWrongKey, "Challenge issued for another API key"
+	}
+	if result.Error != "" {
+		s.updateStats(apiKey, func(stats *StatsEntry) {
+			stats.FailedChallenges++
+		})
+		s.recordFailure(apiKey, ip)
+		return result, nil
+	}
+
+	// Mark the challenge as solved. When the same payload is submitted
+	// concurrently, only one request wins and the others are replays.
+	consumed, err := s.challenges.TryConsume(payload.Challenge, expires)
+	if err != nil {
+		return result, fmt.Errorf("replay store error: %w", err)
+	}
+	if !consumed {
+		s.recordFailure(apiKey, ip)
+		result.Error, result.Message = CodeReplayed, "Challenge already solved"
+		return result, nil
+	}
+
+	s.updateStats(apiKey, func(stats *StatsEntry) {
+		stats.SolvedChallenges++
+	})
+	s.recordSuccess(apiKey, ip)
+	return result, nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/altcha-org/altcha-lib-go"
+	"github.com/go-chi/chi/v5"
+)
+
+// testOrigin is the origin allowed for the test API key
+const testOrigin = "https://example.com"
+
+// testKeys are the keys of the API key created for a test server
+type testKeys struct {
+	ID        string
+	SiteKey   string
+	SecretKey string
+}
+
+// testConfig returns a valid configuration with cheap challenges, limits
+// high enough not to get in the way, and no complexity policies
+func testConfig() ServerConfig {
+	return ServerConfig{
+		HMACKey:        "test-hmac-key",
+		Algorithm:      "SHA-256",
+		Complexity:     1000,
+		ExpireTime:     DefaultExpireTime,
+		ReplayStore:    ReplayStoreMemory,
+		MaxIPs:         DefaultMaxIPs,
+		IPStatsTTL:     DefaultIPStatsTTL,
+		ChallengeRate:  "1000000/1s",
+		ChallengeBurst: 1000000,
+		VerifyRate:     "1000000/1s",
+		VerifyBurst:    1000000,
+		TrustedProxies: DefaultTrustedProxies,
+		IPv4Prefix:     DefaultIPv4Prefix,
+		IPv6Prefix:     DefaultIPv6Prefix,
+		APIKeySources:  DefaultAPIKeySources,
+		LegacyV1:       true,
+		MaxBodyBytes:   DefaultMaxBody,
+		Policies:       []ComplexityPolicyConfig{},
+		APIKeys:        make(map[string]APIKey),
+		Stats:          make(map[string]StatsEntry),
+	}
+}
+
+// newTestServer creates a server with one API key for testOrigin, using
+// the given replay store. configure may change the configuration first.
+func newTestServer(t testing.TB, challenges ChallengeManager, configure func(config *ServerConfig)) (*Server, testKeys) {
+	t.Helper()
+	config := testConfig()
+
+	id, err := GenerateKeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewAPIKey([]string{testOrigin})
+	keys := testKeys{ID: id}
+	if keys.SiteKey, err = key.issue(id); err != nil {
+		t.Fatal(err)
+	}
+	if keys.SecretKey, err = key.issueSecretKey(id); err != nil {
+		t.Fatal(err)
+	}
+	config.APIKeys[id] = key
+
+	if configure != nil {
+		configure(&config)
+	}
+	if err := validateConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(config, challenges)
+	t.Cleanup(s.Close)
+	return s, keys
+}
+
+// newTestMemoryStore creates a memory replay store closed after the test
+func newTestMemoryStore(t testing.TB) ChallengeManager {
+	t.Helper()
+	cm, err := NewMemoryChallengeManager("1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cm.Close() })
+	return cm
+}
+
+// newTestFileStore creates a file replay store closed after the test
+func newTestFileStore(t testing.TB) ChallengeManager {
+	t.Helper()
+	cm, err := NewFileChallengeManager(filepath.Join(t.TempDir(), "verity.replay"), "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cm.Close() })
+	return cm
+}
+
+// testRouter serves the API routes of s like the main router does
+func testRouter(s *Server) http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.proxies.RealIPMiddleware)
+	r.Route("/api/v1", s.apiRoutes(1))
+	r.Route("/api/v2", s.apiRoutes(2))
+	return r
+}
+
+// requestChallenge requests a challenge with the site key
+func requestChallenge(t testing.TB, handler http.Handler, keys testKeys) altcha.Challenge {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/challenge", nil)
+	req.Header.Set("Authorization", "Bearer "+keys.SiteKey)
+	req.Header.Set("Origin", testOrigin)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /challenge = %d: %s", rec.Code, rec.Body)
+	}
+
+	var challenge altcha.Challenge
+	if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// solveChallenge returns the base64-encoded solution of a challenge, as
+// sent in the altcha form field
+func solveChallenge(t testing.TB, challenge altcha.Challenge) string {
+	t.Helper()
+	solution, err := altcha.SolveChallenge(challenge.Challenge, challenge.Salt,
+		altcha.Algorithm(challenge.Algorithm), int(challenge.MaxNumber), 0, nil)
+	if err != nil || solution == nil {
+		t.Fatalf("solving challenge: %v", err)
+	}
+	payload, err := json.Marshal(altcha.Payload{
+		Algorithm: challenge.Algorithm,
+		Challenge: challenge.Challenge,
+		Number:    int64(solution.Number),
+		Salt:      challenge.Salt,
+		Signature: challenge.Signature,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// newSolution requests and solves a challenge. altcha-lib-go treats a
+// number of 0 as unset when verifying, so challenges whose answer is 0
+// are skipped; at the test complexity they come up now and then.
+func newSolution(t testing.TB, handler http.Handler, keys testKeys) string {
+	t.Helper()
+	for {
+		challenge := requestChallenge(t, handler, keys)
+		if challenge.Challenge != hashSolution(challenge, 0) {
+			return solveChallenge(t, challenge)
+		}
+	}
+}
+
+// hashSolution returns the challenge hash a number solves
+func hashSolution(challenge altcha.Challenge, number int) string {
+	hash := sha256.Sum256([]byte(challenge.Salt + strconv.Itoa(number)))
+	return hex.EncodeToString(hash[:])
+}
+
+// newVerifyRequest builds a verification request carrying the secret key
+func newVerifyRequest(path, contentType, body, secretKey string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+secretKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+// decodeError returns the error code of a v2 error response
+func decodeError(t testing.TB, rec *httptest.ResponseRecorder) ErrorCode {
+	t.Helper()
+	var body ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return body.Error
+}
+
+// racingStore holds every verification back after its replay check until
+// all of them got there, so they race for TryConsume
+type racingStore struct {
+	ChallengeManager
+	arrived sync.WaitGroup
+}
+
+func (rs *racingStore) Exists(challenge string) (bool, error) {
+	exists, err := rs.ChallengeManager.Exists(challenge)
+	rs.arrived.Done()
+	done := make(chan struct{})
+	go func() {
+		rs.arrived.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+	return exists, err
+}
+
+func TestVerifyConcurrentReplays(t *testing.T) {
+	const attempts = 50
+	stores := map[string]func(testing.TB) ChallengeManager{
+		ReplayStoreMemory: newTestMemoryStore,
+		ReplayStoreFile:   newTestFileStore,
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := &racingStore{ChallengeManager: newStore(t)}
+			s, keys := newTestServer(t, store, nil)
+			handler := testRouter(s)
+			solution := newSolution(t, handler, keys)
+			store.arrived.Add(attempts)
+
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			recorders := make([]*httptest.ResponseRecorder, attempts)
+			for i := range recorders {
+				recorders[i] = httptest.NewRecorder()
+				wg.Add(1)
+				go func(rec *httptest.ResponseRecorder) {
+					defer wg.Done()
+					req := newVerifyRequest("/api/v2/challenge/verify", "text/plain", solution, keys.SecretKey)
+					<-start
+					handler.ServeHTTP(rec, req)
+				}(recorders[i])
+			}
+			close(start)
+			wg.Wait()
+
+			succeeded, replayed := 0, 0
+			for _, rec := range recorders {
+				switch {
+				case rec.Code == http.StatusOK:
+					succeeded++
+				case rec.Code == http.StatusConflict && decodeError(t, rec) == CodeReplayed:
+					replayed++
+				default:
+					t.Errorf("unexpected response %d: %s", rec.Code, rec.Body)
+				}
+			}
+			if succeeded != 1 || replayed != attempts-1 {
+				t.Fatalf("%d succeeded and %d replayed, want 1 and %d", succeeded, replayed, attempts-1)
+			}
+
+			stats := s.Stats()[keys.ID]
+			if stats.SolvedChallenges != 1 {
+				t.Errorf("SolvedChallenges = %d, want 1", stats.SolvedChallenges)
+			}
+		})
+	}
+}
+
+func TestVerifySolution(t *testing.T) {
+	s, keys := newTestServer(t, newTestMemoryStore(t), nil)
+	handler := testRouter(s)
+
+	// A second key, whose challenges must not verify for the first
+	otherID, _ := GenerateKeyID()
+	other := NewAPIKey([]string{testOrigin})
+	otherSite, _ := other.issue(otherID)
+	s.config.APIKeys[otherID] = other
+	otherSolution := newSolution(t, handler, testKeys{ID: otherID, SiteKey: otherSite})
+
+	valid := newSolution(t, handler, keys)
+	tamper := func(fn func(payload *altcha.Payload)) string {
+		decoded, _ := base64.StdEncoding.DecodeString(newSolution(t, handler, keys))
+		var payload altcha.Payload
+		json.Unmarshal(decoded, &payload)
+		fn(&payload)
+		encoded, _ := json.Marshal(payload)
+		return base64.StdEncoding.EncodeToString(encoded)
+	}
+	// Signed by this server, but already expired
+	past := time.Now().Add(-time.Minute)
+	expiredChallenge, err := altcha.CreateChallenge(altcha.ChallengeOptions{
+		HMACKey:   s.config.HMACKey,
+		MaxNumber: 1000,
+		Expires:   &past,
+		Params:    challengeParams(keys.ID, testOrigin, past.Add(-time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := solveChallenge(t, expiredChallenge)
+
+	wrongNumber := tamper(func(payload *altcha.Payload) { payload.Number++ })
+	decoded, _ := base64.StdEncoding.DecodeString(valid)
+	var forged altcha.Payload
+	json.Unmarshal(decoded, &forged)
+	forged.Number++
+	forgedJSON, _ := json.Marshal(forged)
+	forgedReplay := base64.StdEncoding.EncodeToString(forgedJSON)
+	laterExpiry := tamper(func(payload *altcha.Payload) {
+		payload.Salt = strings.Replace(payload.Salt, "expires=", "expires=9", 1)
+	})
+
+	tests := []struct {
+		name     string
+		solution string
+		want     ErrorCode
+	}{
+		{"valid", valid, ""},
+		{"replayed", valid, CodeReplayed},
+		{"forged replay", forgedReplay, CodeBadSignature},
+		{"not base64", "not base64!", CodeMalformed},
+		{"not JSON", base64.StdEncoding.EncodeToString([]byte("{")), CodeMalformed},
+		{"no salt params", base64.StdEncoding.EncodeToString([]byte(`{"challenge":"x","salt":"y"}`)), CodeMalformed},
+		{"wrong number", wrongNumber, CodeBadSignature},
+		{"tampered expiry", laterExpiry, CodeBadSignature},
+		{"expired", expired, CodeExpired},
+		{"other key", otherSolution, CodeWrongKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.verifySolution(keys.ID, "192.0.2.1", tt.solution)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Error != tt.want {
+				t.Fatalf("error = %q (%s), want %q", result.Error, result.Message, tt.want)
+			}
+			if tt.want == "" && (result.Hostname != "example.com" || result.IssuedAt.IsZero()) {
+				t.Errorf("hostname %q and issue time %v not taken from the challenge", result.Hostname, result.IssuedAt)
+			}
+		})
+	}
+}
+
+func TestVerifyFailuresCountAgainstClient(t *testing.T) {
+	const backendIP, clientIP = "192.0.2.1", "203.0.113.9" // httptest uses backendIP
+
+	tests := []struct {
+		name        string
+		request     func(keys testKeys, solution string) *http.Request
+		wantCharged string // IP whose complexity rises, if any
+	}{
+		{"raw body without remoteip", func(keys testKeys, solution string) *http.Request {
+			return newVerifyRequest("/api/v1/challenge/verify", "", solution, keys.SecretKey)
+		}, ""},
+		{"JSON with remoteip", func(keys testKeys, solution string) *http.Request {
+			body, _ := json.Marshal(verifyRequest{Payload: solution, RemoteIP: clientIP})
+			return newVerifyRequest("/api/v2/challenge/verify", "application/json", string(body), keys.SecretKey)
+		}, clientIP},
+		{"siteverify without remoteip", func(keys testKeys, solution string) *http.Request {
+			body := url.Values{"secret": {keys.SecretKey}, "response": {solution}}
+			return newVerifyRequest("/api/v1/siteverify", "application/x-www-form-urlencoded", body.Encode(), keys.SecretKey)
+		}, ""},
+		{"siteverify with remoteip", func(keys testKeys, solution string) *http.Request {
+			body := url.Values{"secret": {keys.SecretKey}, "response": {solution}, "remoteip": {clientIP}}
+			return newVerifyRequest("/api/v1/siteverify", "application/x-www-form-urlencoded", body.Encode(), keys.SecretKey)
+		}, clientIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+				config.Policies = []ComplexityPolicyConfig{{Type: PolicyFailures, Scope: ScopeIP, HalfLife: "10m", Increase: 1}}
+			})
+			handler := testRouter(s)
+
+			// The second verification is a replay, and counts as a failure
+			solution := newSolution(t, handler, keys)
+			for range 2 {
+				handler.ServeHTTP(httptest.NewRecorder(), tt.request(keys, solution))
+			}
+
+			for _, ip := range []string{backendIP, clientIP} {
+				charged := s.getAdjustedComplexity(keys.ID, s.ipKeys.Key(ip), 1000) > 1000
+				if charged != (ip == tt.wantCharged) {
+					t.Errorf("failure charged to %s: %v, want %v", ip, charged, !charged)
+				}
+			}
+		})
+	}
+}
+
+// verified reports whether a verify response accepted the solution, in the
+// format of either API version
+func verified(t testing.TB, rec *httptest.ResponseRecorder) bool {
+	t.Helper()
+	var body struct {
+		Code    int  `json:"code"`
+		Success bool `json:"success"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return rec.Code == http.StatusOK && (body.Success || body.Code == http.StatusOK)
+}
+
+// multipartBody returns a multipart form with one field, and its content type
+func multipartBody(name, value string) (string, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField(name, value)
+	writer.Close()
+	return body.String(), writer.FormDataContentType()
+}
+
+func TestVerifyRequestBodies(t *testing.T) {
+	const form = "application/x-www-form-urlencoded"
+	jsonBody := func(solution string) (string, string) {
+		body, _ := json.Marshal(verifyRequest{Payload: solution})
+		return string(body), "application/json"
+	}
+	formBody := func(solution string) (string, string) {
+		return url.Values{"altcha": {solution}}.Encode(), form
+	}
+	multipartForm := func(solution string) (string, string) { return multipartBody("altcha", solution) }
+	raw := func(contentType string) func(string) (string, string) {
+		return func(solution string) (string, string) { return solution, contentType }
+	}
+
+	tests := []struct {
+		name       string
+		version    string
+		legacyV1   bool
+		body       func(solution string) (string, string)
+		wantStatus int
+	}{
+		{"JSON", "v2", true, jsonBody, http.StatusOK},
+		{"JSON on v1", "v1", true, jsonBody, http.StatusOK},
+		{"form", "v2", true, formBody, http.StatusOK},
+		{"form on v1", "v1", true, formBody, http.StatusOK},
+		{"multipart", "v2", true, multipartForm, http.StatusOK},
+		{"text", "v2", true, raw("text/plain"), http.StatusOK},
+		{"no content type", "v2", true, raw(""), http.StatusOK},
+		{"no content type on v1", "v1", true, raw(""), http.StatusOK},
+		// Older clients send the bare solution with their default content type
+		{"bare solution as form on v1", "v1", true, raw(form), http.StatusOK},
+		{"bare solution as form on v1 without legacy responses", "v1", false, raw(form), http.StatusBadRequest},
+		{"bare solution as form", "v2", true, raw(form), http.StatusBadRequest},
+		{"form without altcha", "v2", true, func(string) (string, string) { return "remoteip=192.0.2.1", form }, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, keys := newTestServer(t, newTestMemoryStore(t), func(config *ServerConfig) {
+				config.LegacyV1 = tt.legacyV1
+			})
+			handler := testRouter(s)
+
+			body, contentType := tt.body(newSolution(t, handler, keys))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, newVerifyRequest("/api/"+tt.version+"/challenge/verify", contentType, body, keys.SecretKey))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK && !verified(t, rec) {
+				t.Errorf("solution not verified: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestTooLarge(t *testing.T) {
+	s, keys := newTestServer(t, newTestMemoryStore(t), nil)
+	handler := testRouter(s)
+
+	large := strings.Repeat("x", DefaultMaxBody+1)
+	multipartLarge, multipartType := multipartBody("altcha", large)
+	bodies := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"JSON", "application/json", `{"payload":"` + large + `"}`},
+		{"form", "application/x-www-form-urlencoded", "altcha=" + large},
+		{"multipart", multipartType, multipartLarge},
+		{"text", "text/plain", large},
+		{"no content type", "", large},
+	}
+	for _, version := range []string{"v1", "v2"} {
+		for _, tt := range bodies {
+			// Chunked bodies have no length to check up front, and are
+			// only caught while they are read
+			for _, chunked := range []bool{false, true} {
+				name := fmt.Sprintf("%s %s chunked=%v", version, tt.name, chunked)
+				req := newVerifyRequest("/api/"+version+"/challenge/verify", tt.contentType, tt.body, keys.SecretKey)
+				if chunked {
+					req.ContentLength = -1
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusRequestEntityTooLarge {
+					t.Errorf("%s: status = %d, want %d", name, rec.Code, http.StatusRequestEntityTooLarge)
+				}
+			}
+		}
+	}
+
+	// Reading the API key from a form must not hide the size of the body
+	for _, tt := range bodies[1:3] {
+		req := newVerifyRequest("/api/v2/challenge/verify?apiKey="+url.QueryEscape(keys.SecretKey), tt.contentType, tt.body, "")
+		req.Header.Del("Authorization")
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge || decodeError(t, rec) != CodeTooLarge {
+			t.Errorf("%s with form key: status = %d: %s", tt.name, rec.Code, rec.Body)
+		}
+	}
+}